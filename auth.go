@@ -0,0 +1,71 @@
+package carrier3
+
+import (
+    ik  "github.com/devguardio/identity/go"
+    "github.com/devguardio/carrier3/v3/api"
+
+    "errors"
+    "fmt"
+    "sync"
+)
+
+var ErrUnauthorized = errors.New("unauthorized")
+
+// Authorizer decides whether a caller may open a stream to the device.
+// it is asked after the end to end handshake, see H1Link.E2E.
+// caller was proven with end to end tls if proven is set, and is only what the broker claims in connect.Caller otherwise.
+// an error rejects the stream, and its text is sent back as the reason, so it should not leak secrets.
+// it is called concurrently for callers arriving at the same time and may block, holding up only the caller it decides on.
+type Authorizer interface {
+    Authorize(caller *ik.Identity, proven bool, connect *api.Connect) error
+}
+
+type AuthorizerFunc func(caller *ik.Identity, proven bool, connect *api.Connect) error
+
+func (self AuthorizerFunc) Authorize(caller *ik.Identity, proven bool, connect *api.Connect) error {
+    return self(caller, proven, connect)
+}
+
+// AllowList accepts only callers with one of its identities, proven with end to end tls. it can be changed while the link is running
+type AllowList struct {
+    mu  sync.RWMutex
+    ids map[ik.Identity]bool
+
+    // also accept callers that are only claimed by the broker, trusting it not to impersonate anyone
+    AllowUnproven bool
+}
+
+func NewAllowList(ids ...ik.Identity) *AllowList {
+    self := &AllowList{
+        ids: make(map[ik.Identity]bool),
+    }
+    for _, id := range ids {
+        self.ids[id] = true
+    }
+    return self
+}
+
+func (self *AllowList) Add(id ik.Identity) {
+    self.mu.Lock()
+    defer self.mu.Unlock()
+    self.ids[id] = true
+}
+
+func (self *AllowList) Remove(id ik.Identity) {
+    self.mu.Lock()
+    defer self.mu.Unlock()
+    delete(self.ids, id)
+}
+
+func (self *AllowList) Authorize(caller *ik.Identity, proven bool, connect *api.Connect) error {
+    self.mu.RLock()
+    defer self.mu.RUnlock()
+
+    if !self.ids[*caller] {
+        return fmt.Errorf("%w: %s is not allowed on this device", ErrUnauthorized, caller.String())
+    }
+    if !proven && !self.AllowUnproven {
+        return fmt.Errorf("%w: %s must use end to end tls on this device", ErrUnauthorized, caller.String())
+    }
+    return nil
+}
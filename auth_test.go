@@ -0,0 +1,173 @@
+package carrier3
+
+import (
+    ik  "github.com/devguardio/identity/go"
+    "github.com/devguardio/carrier3/v3/api"
+    "testing"
+    "encoding/json"
+    "net/http"
+    "io/ioutil"
+    "io"
+    "bufio"
+    "strings"
+    "time"
+)
+
+func TestRejectCast(t *testing.T) {
+
+    for name, test := range map[string]struct {
+        caller  string
+        reason  string
+    }{
+        "not allowed":  {caller(t), "is not allowed on this device"},
+        "empty":        {"", "invalid caller identity"},
+        "invalid":      {"not an identity", "invalid caller identity"},
+    } {
+        t.Run(name, func(t *testing.T) {
+
+            link, brokers := pipeLink(t)
+            link.Authorizer = NewAllowList()
+
+            events := make(chan LinkEvent, 16)
+            link.OnEvent = func(e LinkEvent) { events <- e }
+
+            go link.listen()
+
+            brk := <- brokers
+            fakeRegister(t, brk, "1")
+            fakeCaller(t, brk, test.caller)
+
+            resp, err := http.ReadResponse(bufio.NewReader(brk), nil)
+            if err != nil { t.Fatal(err) }
+            body, _ := ioutil.ReadAll(resp.Body)
+            if resp.StatusCode != http.StatusForbidden || !strings.Contains(string(body), test.reason) {
+                t.Fatalf("expected 403 for '%s', got %s: %s", test.reason, resp.Status, body)
+            }
+
+            for {
+                e := nextEvent(t, events)
+                if e.Type == LinkRejected {
+                    if e.Caller != test.caller { t.Fatalf("rejected %+v", e) }
+                    break
+                }
+            }
+
+            // the listen connection is used up, and replaced
+            fakeRegister(t, <- brokers, "2")
+        })
+    }
+}
+
+func TestRejectMux(t *testing.T) {
+
+    for name, test := range map[string]struct {
+        caller  string
+        reason  string
+    }{
+        "not allowed":  {caller(t), "is not allowed on this device"},
+        "empty":        {"", "invalid caller identity"},
+        "invalid":      {"not an identity", "invalid caller identity"},
+    } {
+        t.Run(name, func(t *testing.T) {
+
+            broker := newFakeMux(t)
+            broker.link.Authorizer = NewAllowList()
+
+            js, err := json.Marshal(map[string]string{"Caller": test.caller})
+            if err != nil { t.Fatal(err) }
+            broker.send(muxOpen, 1, js)
+
+            // callers the Authorizer turns away get a 403 on the stream, ones without an identity only the reset
+            var said []byte
+            for f := broker.next(); ; f = broker.next() {
+                if f.id != 1 { t.Fatalf("frame %d on stream %d", f.typ, f.id) }
+                said = append(said, f.payload...)
+                if f.typ == muxReset { break }
+            }
+            if !strings.Contains(string(said), test.reason) {
+                t.Fatalf("expected rejection for '%s', got %q", test.reason, said)
+            }
+
+            // the session is fine
+            broker.quiet()
+        })
+    }
+}
+
+func TestAuthorizeOffReadLoop(t *testing.T) {
+
+    me, err := ik.Vault().Identity()
+    if err != nil { t.Fatal(err) }
+    var slow ik.Identity
+    slow[0] = 1
+
+    release := make(chan struct{})
+    broker := newFakeMux(t)
+    broker.link.Authorizer = AuthorizerFunc(func(caller *ik.Identity, proven bool, connect *api.Connect) error {
+        if caller.Equal(&slow) {
+            <- release
+        }
+        return nil
+    })
+
+    js, err := json.Marshal(map[string]string{"Caller": slow.String()})
+    if err != nil { t.Fatal(err) }
+    broker.send(muxOpen, 1, js)
+    broker.send(muxData, 1, []byte("early"))
+
+    // others aren't held up by a slow decision
+    broker.quiet()
+    if c := broker.open(3, me.String()); !c.(*H1Stream).CallerIdentity.Equal(me) {
+        t.Fatal("accepted the wrong stream")
+    }
+
+    close(release)
+    select {
+        case c := <- broker.link.accepted:
+            var b [5]byte
+            _, err := c.Read(b[:])
+            if err != nil || string(b[:]) != "early" {
+                t.Fatalf("read %q %v", b, err)
+            }
+        case <- time.After(5 * time.Second):
+            t.Fatal("slow caller not accepted")
+    }
+}
+
+func TestRejectUnproven(t *testing.T) {
+
+    me, err := ik.Vault().Identity()
+    if err != nil { t.Fatal(err) }
+
+    link, brokers := pipeLink(t)
+    link.E2E        = E2EOptional
+    link.Authorizer = NewAllowList(*me)
+    go link.listen()
+    r := http.NewServeMux()
+    r.Handle("/v1/shell", NewShellHandler("/bin/sh"))
+    go http.Serve(link, r)
+
+    // the broker says it's an allowed caller, but can't prove it
+    brk := <- brokers
+    fakeRegister(t, brk, "1")
+    fakeCaller(t, brk, me.String())
+    go io.WriteString(brk, "GET /v1/shell HTTP/1.1\r\nHost: device\r\nCommand: id\r\n\r\n")
+    if reason := rejection(t, brk); !strings.Contains(reason, "must use end to end tls") {
+        t.Fatalf("rejected with %s", reason)
+    }
+
+    // the same caller proving it gets through
+    brk = <- brokers
+    fakeRegister(t, brk, "2")
+    fakeCaller(t, brk, me.String())
+    conn, err := E2EClient(brk, ik.Vault(), me)
+    if err != nil { t.Fatal(err) }
+    _, err = io.WriteString(conn, "GET /v1/nope HTTP/1.1\r\nHost: device\r\n\r\n")
+    if err != nil { t.Fatal(err) }
+    resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+    if err != nil { t.Fatal(err) }
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusNotFound {
+        t.Fatalf("expected the proven caller to get to the handler, got %s", resp.Status)
+    }
+}
@@ -1,6 +1,7 @@
 package cli
 
 import (
+    "context"
     "crypto/tls"
     "crypto/x509"
     "encoding/binary"
@@ -9,7 +10,7 @@ import (
     "github.com/devguardio/carrier3/v3"
     "golang.org/x/term"
     ik      "github.com/devguardio/identity/go"
-    iktls   "github.com/devguardio/identity/go/tls"
+    "github.com/devguardio/carrier3/v3/surface"
     "io"
     "net/http"
     "os"
@@ -18,58 +19,237 @@ import (
     "golang.org/x/crypto/ssh/terminal"
     "bufio"
     "bytes"
+    "net"
+    "net/url"
+    "strconv"
+    "sync"
+    "time"
 )
 
-func Shell(vault ik.VaultI, target string, cmd string, disable_pty bool, force_pty bool) (exitCode int) {
+// the broker used when neither a surface nor a broker url is given
+const DefaultBroker = "https://carrier.devguard.io"
 
-    requestPTY := terminal.IsTerminal(syscall.Stdin)
-    if disable_pty {
-        requestPTY = false
-    } else if force_pty {
-        requestPTY = true
+// ShellDialer connects to the ingresses of the surface document at surfacePath, like a device would,
+// or to the broker at url with the system roots, if surfacePath is empty
+func ShellDialer(vault ik.VaultI, surfacePath string, broker string) *surface.Dialer {
+
+    if surfacePath != "" {
+        store := surface.NewFileStore(surfacePath)
+        sf, err := store.Load()
+        if err != nil { panic(err) }
+
+        dialer := surface.NewDialer(vault, sf)
+        dialer.Updater  = &surface.Updater{OnUpdate: store.Save}
+        dialer.Clock    = surface.DefaultClock
+        return dialer
     }
-    var printHeaders = requestPTY;
 
-    tlsconf, err := iktls.NewTlsClient(vault)
-    if err != nil { panic(err) }
-    tlsconf.RootCAs, _ = x509.SystemCertPool()
-    tlsconf.ServerName = "carrier.devguard.io"
+    if broker == "" {
+        broker = DefaultBroker
+    }
+    u, err := url.Parse(broker)
+    if err != nil { panic(fmt.Errorf("broker: %w", err)) }
+    if u.Scheme != "https" || u.Hostname() == "" {
+        panic(fmt.Errorf("broker: expected https://host[:port], got %s", broker))
+    }
 
-    conn, err := tls.Dial("tcp", "carrier.devguard.io:443", tlsconf)
-    if err != nil { panic(err) }
-    defer conn.Close();
+    var port uint64 = 443
+    if u.Port() != "" {
+        port, err = strconv.ParseUint(u.Port(), 10, 16)
+        if err != nil { panic(fmt.Errorf("broker: %w", err)) }
+    }
+
+    // a surface with just the broker, checked against the system time since there's no document time
+    sf := &surface.Surface{
+        Time:       time.Now(),
+        Ingresses:  []surface.Ingress{{
+            Name:       u.Hostname(),
+            Port:       uint16(port),
+            Protocols:  []string{"h2", "http/1.1"},
+        }},
+    }
 
-    req, err := http.NewRequest("POST", "https://carrier.devguard.io/v1/shell", nil)
+    dialer := surface.NewDialer(vault, sf)
+    dialer.Roots, err = x509.SystemCertPool()
     if err != nil { panic(err) }
+    return dialer
+}
 
-    req.Header.Add("Target",  target)
-    req.Header.Add("Mux",     "true")
-    if requestPTY {
-        req.Header.Add("Pty", "true")
-    }
-    if cmd != "" {
-        req.Header.Add("Command", cmd)
+// ShellProtocols are offered to ingresses that list them, in order of preference.
+// h2 streams both directions without chunked request bodies, which some proxies buffer
+var ShellProtocols = []string{"h2", "http/1.1"}
+
+// the protocols to offer with dialer. h2 is taken wherever an ingress lists it,
+// even though surface updates and clock sync are only spoken over http/1.1 and skipped then
+func shellProtocols(dialer *surface.Dialer) []string {
+    if len(dialer.Protocols) > 0 {
+        return dialer.Protocols
     }
+    return ShellProtocols
+}
 
-    if os.Getenv("TERM") != "" {
-        req.Header.Add("Env", "TERM=" + os.Getenv("TERM"))
+// start a shell request on conn, with h2 if it was negotiated or else a hand written chunked http1 request.
+// returns the response and a writer for the request body
+func shellRequest(conn *tls.Conn, req *http.Request) (*http.Response, io.Writer, error) {
+
+    if conn.ConnectionState().NegotiatedProtocol == "h2" {
+
+        // the bundled h2 client, on the connection we already verified
+        var dialed = false
+        transport := &http.Transport{
+            ForceAttemptHTTP2: true,
+            DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+                if dialed {
+                    return nil, fmt.Errorf("shell connection already used")
+                }
+                dialed = true
+                return conn, nil
+            },
+        }
+
+        R, W := io.Pipe()
+        req.Body            = R
+        req.ContentLength   = -1
+
+        resp, err := transport.RoundTrip(req)
+        if err != nil { return nil, nil, err }
+        return resp, W, nil
     }
 
     // have to manually write the request because golang has some bad assumptions for request body
     rqb := bytes.Buffer{}
-    req.Header.Add("Host", "carrier.devguard.io" )
+    req.Header.Add("Host", req.Host)
     req.Header.Add("Connection", "close")
     req.Header.Add("Transfer-Encoding", "chunked")
 
-    rqb.Write([]byte("POST /v1/shell HTTP/1.1\r\n"))
+    rqb.Write([]byte("POST " + req.URL.RequestURI() + " HTTP/1.1\r\n"))
     req.Header.Write(&rqb)
     rqb.Write([]byte("\r\n"))
 
-    conn.Write(rqb.Bytes())
+    _, err := conn.Write(rqb.Bytes())
+    if err != nil { return nil, nil, err }
 
     // read response
     resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+    if err != nil { return nil, nil, err }
+
+    return resp, carrier3.NewChunkedWriter(conn), nil
+}
+
+// the shell request to the device. Host is only for the device's router
+func shellHeaders(req *http.Request, requestPTY bool, cmd string) {
+    if requestPTY {
+        req.Header.Add("Pty", "true")
+    }
+    if cmd != "" {
+        req.Header.Add("Command", cmd)
+    }
+    if os.Getenv("TERM") != "" {
+        req.Header.Add("Env", "TERM=" + os.Getenv("TERM"))
+    }
+}
+
+// starts end to end tls with target on the stream the broker relays after its 200,
+// and sends the shell request inside it, so the broker can neither read the session nor impersonate us
+func e2eShellRequest(vault ik.VaultI, target string, R io.ReadCloser, W io.Writer, requestPTY bool, cmd string) (*http.Response, io.Writer, error) {
+
+    device, err := ik.IdentityFromString(target)
+    if err != nil { return nil, nil, fmt.Errorf("end to end tls needs the target's identity: %w", err) }
+
+    conn, err := carrier3.E2EClient(newRelayConn(R, W), vault, device)
+    if err != nil { return nil, nil, err }
+
+    req, err := http.NewRequest("POST", "https://device/v1/shell", nil)
+    if err != nil { return nil, nil, err }
+    shellHeaders(req, requestPTY, cmd)
+
+    return shellRequest(conn, req)
+}
+
+// the body of a request and of its response as one connection
+type relayConn struct {
+    R       io.ReadCloser
+    W       io.Writer
+
+    mu      sync.Mutex
+    timer   *time.Timer
+}
+
+func newRelayConn(R io.ReadCloser, W io.Writer) *relayConn {
+    return &relayConn{R: R, W: W}
+}
+
+func (self *relayConn) Read(p []byte) (int, error)  { return self.R.Read(p) }
+func (self *relayConn) Write(p []byte) (int, error) { return self.W.Write(p) }
+
+func (self *relayConn) Close() error {
+    if c, ok := self.W.(io.Closer); ok {
+        c.Close()
+    }
+    return self.R.Close()
+}
+
+// there is no way to interrupt a single read, so a passed deadline closes the connection
+func (self *relayConn) SetDeadline(t time.Time) error {
+    self.mu.Lock()
+    defer self.mu.Unlock()
+
+    if self.timer != nil {
+        self.timer.Stop()
+        self.timer = nil
+    }
+    if !t.IsZero() {
+        self.timer = time.AfterFunc(time.Until(t), func() { self.Close() })
+    }
+    return nil
+}
+func (self *relayConn) SetReadDeadline(t time.Time) error   { return self.SetDeadline(t) }
+func (self *relayConn) SetWriteDeadline(t time.Time) error  { return self.SetDeadline(t) }
+
+func (self *relayConn) LocalAddr() net.Addr     { return relayAddr{} }
+func (self *relayConn) RemoteAddr() net.Addr    { return relayAddr{} }
+
+type relayAddr struct{}
+func (relayAddr) Network() string   { return "relay" }
+func (relayAddr) String() string    { return "broker" }
+
+// Shell runs cmd, or an interactive shell, on target.
+// with e2e, the broker relays the stream as is and the session runs inside tls with target, which must be an identity
+func Shell(dialer *surface.Dialer, target string, cmd string, disable_pty bool, force_pty bool, e2e bool) (exitCode int) {
+
+    requestPTY := terminal.IsTerminal(syscall.Stdin)
+    if disable_pty {
+        requestPTY = false
+    } else if force_pty {
+        requestPTY = true
+    }
+    var printHeaders = requestPTY;
+
+    dialer.Protocols = shellProtocols(dialer)
+
+    conn, ingress, err := dialer.DialContext(context.Background())
     if err != nil { panic(err) }
+    defer conn.Close();
+
+    req, err := http.NewRequest("POST", "https://" + ingress.Host() + "/v1/shell", nil)
+    if err != nil { panic(err) }
+
+    req.Header.Add("Target",  target)
+    req.Header.Add("Mux",     "true")
+    if e2e {
+        // the shell request goes to the device itself, after the broker's 200
+        req.Header.Add("E2E",   "tls")
+    } else {
+        shellHeaders(req, requestPTY, cmd)
+    }
+
+    resp, W, err := shellRequest(conn, req)
+    if err != nil { panic(err) }
+
+    if e2e && resp.StatusCode == http.StatusOK {
+        resp, W, err = e2eShellRequest(dialer.Vault, target, resp.Body, W, requestPTY, cmd)
+        if err != nil { panic(err) }
+    }
 
     if printHeaders {
         fmt.Fprintf(os.Stderr, "%s %s\n", resp.Proto, resp.Status);
@@ -94,7 +274,6 @@ func Shell(vault ik.VaultI, target string, cmd string, disable_pty bool, force_p
     }
 
     R := resp.Body
-    W := carrier3.NewChunkedWriter(conn)
 
     // golang http client won't send the request if there's no start of body
     // W.Write([]byte{carrier3.ShellFrameTypePing, 0, 0, 0})
@@ -0,0 +1,140 @@
+package cli
+
+import (
+    "github.com/devguardio/carrier3/v3/surface"
+    ik      "github.com/devguardio/identity/go"
+    iktls   "github.com/devguardio/identity/go/tls"
+    "testing"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "net/http/httputil"
+    "crypto/tls"
+    "bufio"
+    "io"
+    "io/ioutil"
+)
+
+func TestShellRequest(t *testing.T) {
+
+    // like a broker: headers first, then the shell frames both ways
+    srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+        // the http1 server won't read the body after the response started, so do it by hand
+        if r.ProtoMajor == 1 {
+            conn, bio, err := w.(http.Hijacker).Hijack()
+            if err != nil { t.Error(err); return }
+            defer conn.Close()
+            io.WriteString(conn, "HTTP/1.1 200 OK\r\nProto: " + r.Proto + "\r\nConnection: close\r\n\r\n")
+
+            var b [5]byte
+            if _, err := io.ReadFull(httputil.NewChunkedReader(bio), b[:]); err != nil { return }
+            conn.Write(append([]byte("echo "), b[:]...))
+            return
+        }
+
+        w.Header().Set("Proto", r.Proto)
+        w.WriteHeader(http.StatusOK)
+        w.(http.Flusher).Flush()
+
+        var b [5]byte
+        if _, err := io.ReadFull(r.Body, b[:]); err != nil { return }
+        w.Write(append([]byte("echo "), b[:]...))
+    }))
+    srv.EnableHTTP2 = true
+    srv.StartTLS()
+    defer srv.Close()
+
+    for proto, want := range map[string]string{"h2": "HTTP/2.0", "http/1.1": "HTTP/1.1"} {
+        conn, err := tls.Dial("tcp", srv.Listener.Addr().String(), &tls.Config{
+            InsecureSkipVerify: true,
+            NextProtos:         []string{proto},
+        })
+        if err != nil { t.Fatal(err) }
+
+        req, err := http.NewRequest("POST", "https://ingress.test/v1/shell", nil)
+        if err != nil { t.Fatal(err) }
+
+        resp, W, err := shellRequest(conn, req)
+        if err != nil { t.Fatalf("%s: %v", proto, err) }
+        if got := resp.Header.Get("Proto"); got != want {
+            t.Fatalf("%s: request arrived as %s", proto, got)
+        }
+
+        _, err = W.Write([]byte("hello"))
+        if err != nil { t.Fatal(err) }
+
+        b, err := io.ReadAll(resp.Body)
+        if err != nil { t.Fatalf("%s: %v", proto, err) }
+        if string(b) != "echo hello" {
+            t.Fatalf("%s: got %q", proto, b)
+        }
+        conn.Close()
+    }
+}
+
+func TestShellProtocols(t *testing.T) {
+    dialer := surface.NewDialer(nil, &surface.Surface{})
+    if p := shellProtocols(dialer); len(p) != 2 || p[0] != "h2" {
+        t.Fatalf("expected h2 to be offered, got %v", p)
+    }
+
+    // even if that means the surface isn't updated over it
+    dialer.Updater = &surface.Updater{}
+    if p := shellProtocols(dialer); len(p) != 2 || p[0] != "h2" {
+        t.Fatalf("h2 not offered with an updater, got %v", p)
+    }
+
+    dialer.Protocols = []string{"http/1.1"}
+    if p := shellProtocols(dialer); len(p) != 1 || p[0] != "http/1.1" {
+        t.Fatalf("dialer protocols not kept, got %v", p)
+    }
+}
+
+func TestShellE2E(t *testing.T) {
+
+    vault := ik.Vault()
+    me, err := vault.Identity()
+    if err != nil { t.Fatal(err) }
+
+    cert, err := surface.SelfCert(vault)
+    if err != nil { t.Fatal(err) }
+
+    // the stream the broker relays after its 200, with the device at the other end
+    relay, dev := net.Pipe()
+    defer relay.Close()
+
+    device := make(chan *http.Request, 1)
+    go func() {
+        conn := tls.Server(dev, &tls.Config{
+            MinVersion:             tls.VersionTLS13,
+            Certificates:           []tls.Certificate{cert},
+            ClientAuth:             tls.RequireAnyClientCert,
+            VerifyPeerCertificate:  iktls.VerifyPeerCertificate,
+        })
+        defer conn.Close()
+        req, err := http.ReadRequest(bufio.NewReader(conn))
+        if err != nil { t.Error(err); close(device); return }
+        device <- req
+        io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+    }()
+
+    resp, _, err := e2eShellRequest(vault, me.String(), relay, relay, false, "uptime")
+    if err != nil { t.Fatal(err) }
+
+    req := <- device
+    if req == nil { t.FailNow() }
+    if req.URL.Path != "/v1/shell" || req.Header.Get("Command") != "uptime" {
+        t.Fatalf("device got %s %s %v", req.Method, req.URL, req.Header)
+    }
+    body, _ := ioutil.ReadAll(resp.Body)
+    if resp.StatusCode != http.StatusOK || string(body) != "ok" {
+        t.Fatalf("%s: %s", resp.Status, body)
+    }
+
+    // the target has to be an identity to check the device against
+    _, _, err = e2eShellRequest(vault, "some-device", relay, relay, false, "")
+    if err == nil {
+        t.Fatal("e2e with a target that isn't an identity")
+    }
+}
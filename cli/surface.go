@@ -12,8 +12,126 @@ import (
     "net"
     "encoding/pem"
     "crypto/x509"
+    "path/filepath"
 )
 
+// per ingress flags shared by make and next
+type ingressFlags struct {
+    name        [16]string
+    identity    [16]string
+    ips         [16][]string
+    certFiles   [16][]string
+    port        [16]uint16
+    alpn        [16][]string
+}
+
+func (self *ingressFlags) register(cmd *cobra.Command) {
+    for i := 0; i < 16; i++ {
+        cmd.Flags().StringVar(&self.name[i], fmt.Sprintf("name%d",i),  "", fmt.Sprintf("domain name (%d)", i))
+        cmd.Flags().StringVar(&self.identity[i], fmt.Sprintf("identity%d",i),  "", fmt.Sprintf("identity (%d)", i))
+        cmd.Flags().StringSliceVar(&self.ips[i], fmt.Sprintf("ip%d",i),  []string{}, fmt.Sprintf("ip (%d)", i))
+        cmd.Flags().StringSliceVar(&self.certFiles[i], fmt.Sprintf("cert-file%d",i),  []string{}, fmt.Sprintf("cert from file (%d)", i))
+        cmd.Flags().Uint16Var(&self.port[i], fmt.Sprintf("port%d",i),  0, fmt.Sprintf("tcp port, if not 443 (%d)", i))
+        cmd.Flags().StringSliceVar(&self.alpn[i], fmt.Sprintf("alpn%d",i),  []string{}, fmt.Sprintf("alpn protocols in order of preference (%d)", i))
+    }
+}
+
+// apply replaces every field of sf that was given on the command line
+func (self *ingressFlags) apply(cmd *cobra.Command, sf *surface.Surface) {
+    changed := func(flag string, i int) bool {
+        return cmd.Flags().Changed(fmt.Sprintf("%s%d", flag, i))
+    }
+
+    for i := 0; i < 16; i++ {
+        var ingress *surface.Ingress
+        for _, flag := range []string{"name", "identity", "ip", "cert-file", "port", "alpn"} {
+            if changed(flag, i) {
+                ingress = sf.Ingress(i)
+            }
+        }
+        if ingress == nil { continue }
+
+        if changed("name", i) {
+            ingress.Name = self.name[i]
+        }
+
+        if changed("identity", i) {
+            ingress.Identity = nil
+            if self.identity[i] != "" {
+                id, err := identity.IdentityFromString(self.identity[i])
+                if err != nil { panic(fmt.Errorf("identity%d: %w", i, err)) }
+                ingress.Identity = id
+            }
+        }
+
+        if changed("ip", i) {
+            ingress.IP = nil
+            for _, ips := range self.ips[i] {
+                ip := net.ParseIP(ips)
+                if ip == nil {panic(fmt.Errorf("ip%d: cannot parse", i))}
+                ingress.IP = append(ingress.IP, ip)
+            }
+        }
+
+        if changed("cert-file", i) {
+            ingress.Certs = nil
+            for _, certfile := range self.certFiles[i] {
+                p, err := ioutil.ReadFile(certfile)
+                if err != nil { panic(fmt.Errorf("cert-file%d: %w", i, err))}
+                block, _ := pem.Decode([]byte(p))
+                if block == nil { panic(fmt.Errorf("cert-file%d: cannot parse pem", i))}
+                cert, err := x509.ParseCertificate(block.Bytes)
+                if err != nil { panic(fmt.Errorf("cert-file%d: cannot parse cert: %w", i, err))}
+                ingress.Certs = append(ingress.Certs, cert)
+            }
+        }
+
+        if changed("port", i) {
+            ingress.Port = self.port[i]
+        }
+
+        if changed("alpn", i) {
+            ingress.Protocols = self.alpn[i]
+        }
+    }
+}
+
+func readSecret(path string) *identity.Secret {
+    p, err := ioutil.ReadFile(path)
+    if err != nil { panic(err) }
+    secret, err := identity.SecretFromString(string(p))
+    if err != nil { panic(fmt.Errorf("%s: %w", path, err)) }
+    return secret
+}
+
+// the unknown tail of a document is in the record layout of its version, so it can't move to another one
+func setVersion(sf *surface.Surface, version uint8) {
+    var from = sf.Version
+    if from == 0 {
+        from = 1
+    }
+    var to = version
+    if to == 0 {
+        to = 1
+    }
+    if from != to && len(sf.Unknown) > 0 {
+        panic(fmt.Errorf("--version: cannot convert from version %d to %d, the document has %d bytes of fields this carrier doesn't know",
+            from, to, len(sf.Unknown)))
+    }
+    sf.Version = version
+}
+
+func writeSurface(path string, sf *surface.Surface, secret *identity.Secret, format string) {
+    f, err := surface.FormatFromString(format)
+    if err != nil { panic(err) }
+    b, err := sf.Encode(f)
+    if err != nil { panic(err) }
+    err = ioutil.WriteFile(path, b, 0644)
+    if err != nil { panic(err) }
+    err = ioutil.WriteFile(path + ".secret", []byte(secret.ToString()), 0600)
+    if err != nil { panic(err) }
+}
+
 
 func SurfaceCmd() * cobra.Command {
 
@@ -22,11 +140,13 @@ func SurfaceCmd() * cobra.Command {
         Short:      "signed surface documents",
     }
 
-    var sf surface.Surface
-
-    var arg_identity    [16]string
-    var arg_ips         [16][]string
-    var arg_cert_file   [16][]string
+    var arg_ingress     ingressFlags
+    var arg_sign        string
+    var arg_serial      uint64
+    var arg_precedent   uint64
+    var arg_from        string
+    var arg_format      string
+    var arg_version     uint8
 
     makeCmd := &cobra.Command{
         Use:        "make <outfile>",
@@ -34,6 +154,21 @@ func SurfaceCmd() * cobra.Command {
         Args:       cobra.MinimumNArgs(1),
         Run: func(cmd *cobra.Command, args []string) {
 
+            var sf = &surface.Surface{}
+            if arg_from != "" {
+                sf = loadSource(arg_from)
+                sf.Signature = nil
+            } else if !cmd.Flags().Changed("serial") || !cmd.Flags().Changed("precedent") {
+                panic("--serial and --precedent are required without --from")
+            }
+
+            if cmd.Flags().Changed("serial") {
+                sf.Serial = identity.Serial(arg_serial)
+            }
+            if cmd.Flags().Changed("precedent") {
+                sf.Precedent = identity.Serial(arg_precedent)
+            }
+
             secret, err := identity.CreateSecret();
             if err != nil { panic(err) }
 
@@ -41,81 +176,221 @@ func SurfaceCmd() * cobra.Command {
             if err != nil { panic(err) }
             copy(sf.Sequencer[:], id[:])
 
-            outfile, err := os.Create(args[0])
-            if err != nil { panic(err) }
+            if cmd.Flags().Changed("version") {
+                setVersion(sf, arg_version)
+            }
 
-            sf.Time = time.Now();
+            if sf.Time.IsZero() {
+                sf.Time = time.Now();
+            }
 
-            for i := 0; i < 16; i++ {
-                if arg_identity[i] != "" {
-                    id, err := identity.IdentityFromString(arg_identity[i])
-                    if err != nil { panic(fmt.Errorf("identity%d: %w", i, err)) }
+            arg_ingress.apply(cmd, sf)
 
-                    sf.Ingresses[i].Identity = id
-                }
+            if sf.Precedent >= sf.Serial {
+                panic("precedent must be < serial")
+            }
 
+            if arg_sign != "" {
+                err = sf.Sign(readSecret(arg_sign))
+                if err != nil { panic(err) }
+            }
 
-                for _, ips := range arg_ips[i] {
-                    ip := net.ParseIP(ips)
-                    if ip == nil {panic(fmt.Errorf("ip%d: cannot parse", i))}
-                    sf.Ingresses[i].IP = append(sf.Ingresses[i].IP, ip)
-                }
+            writeSurface(args[0], sf, secret, arg_format)
+        },
+    }
+    makeCmd.Flags().Uint64Var(&arg_serial, "serial",  0, "serial nr")
+    makeCmd.Flags().Uint64Var(&arg_precedent, "precedent",  0, "precedent nr")
+    makeCmd.Flags().StringVar(&arg_from, "from",  "", "start from a json or yaml file in the shape dump prints. flags replace its fields")
+
+    makeCmd.Flags().StringVar(&arg_sign, "sign",  "", "sign with the .secret file of the precedent document")
+
+    makeCmd.Flags().StringVar(&arg_format, "format",  "raw", "write as raw, pem or message")
+    makeCmd.Flags().Uint8Var(&arg_version, "version",  1, "surface format version. 2 allows more than 16 ingresses and larger documents, but older carriers can't read it")
+
+    arg_ingress.register(makeCmd)
+
+    rootCmd.AddCommand(makeCmd)
+
+
+    var next_ingress    ingressFlags
+    var next_secret     string
+    var next_serial     uint64
+    var next_time       string
+    var next_remove     []int
+    var next_format     string
+    var next_version    uint8
 
-                for _, certfile := range arg_cert_file[i] {
-                    p, err := ioutil.ReadFile(certfile)
-                    block, _ := pem.Decode([]byte(p))
-                    if block == nil { panic(fmt.Errorf("cert-file%d: cannot parse pem", i))}
-                    cert, err := x509.ParseCertificate(block.Bytes)
-                    if err != nil { panic(fmt.Errorf("cert-file%d: cannot parse cert: %w", i, err))}
-                    sf.Ingresses[i].Certs = append(sf.Ingresses[i].Certs, cert)
+    nextCmd := &cobra.Command{
+        Use:        "next <prev> <outfile>",
+        Short:      "create the successor of a surface",
+        Long:       "copies the ingresses of <prev>, applies the changes given as flags and signs the result with the sequencer secret of <prev>",
+        Args:       cobra.MinimumNArgs(2),
+        Run: func(cmd *cobra.Command, args []string) {
+            prev := loadSurface(args[0])
+            signer := readSecret(next_secret)
+
+            seq, err := signer.Identity()
+            if err != nil { panic(err) }
+            if *seq != prev.Sequencer {
+                panic(fmt.Errorf("%s is not the sequencer secret of %s", next_secret, args[0]))
+            }
+
+            t := time.Now()
+            if next_time != "" {
+                t, err = time.Parse(time.RFC3339, next_time)
+                if err != nil { panic(fmt.Errorf("time: %w", err)) }
+            }
+
+            sf, secret, err := prev.Next(t)
+            if err != nil { panic(err) }
+
+            if cmd.Flags().Changed("serial") {
+                if identity.Serial(next_serial) <= prev.Serial {
+                    panic(fmt.Errorf("serial must be > %d", prev.Serial))
                 }
+                sf.Serial = identity.Serial(next_serial)
+            }
 
+            if cmd.Flags().Changed("version") {
+                setVersion(sf, next_version)
             }
 
-            if sf.Precedent >= sf.Serial {
-                panic("precedent must be < serial")
+            for _, i := range next_remove {
+                if i < 0 || i >= len(sf.Ingresses) {
+                    panic(fmt.Errorf("remove: no ingress %d", i))
+                }
+                sf.Ingresses[i] = surface.Ingress{}
             }
 
-            b := sf.Serialize()
-            outfile.Write(b)
+            next_ingress.apply(cmd, sf)
 
-            outfileSecret, err := os.Create(args[0] + ".secret")
+            err = sf.Sign(signer)
             if err != nil { panic(err) }
-            outfileSecret.Write([]byte(secret.ToString()))
+
+            writeSurface(args[1], sf, secret, next_format)
         },
     }
-    makeCmd.Flags().Uint64Var((*uint64)(&sf.Serial), "serial",  0, "serial nr")
-    makeCmd.MarkFlagRequired("serial");
+    nextCmd.Flags().StringVar(&next_secret, "secret",  "", "the .secret file of <prev>")
+    nextCmd.MarkFlagRequired("secret");
+    nextCmd.Flags().Uint64Var(&next_serial, "serial",  0, "serial nr (default: serial of <prev> + 1)")
+    nextCmd.Flags().StringVar(&next_time, "time",  "", "document time as RFC3339 (default: now)")
+    nextCmd.Flags().IntSliceVar(&next_remove, "remove",  []int{}, "clear these ingresses before applying changes")
 
-    makeCmd.Flags().Uint64Var((*uint64)(&sf.Precedent), "precedent",  0, "precedent nr")
-    makeCmd.MarkFlagRequired("precedent");
+    nextCmd.Flags().StringVar(&next_format, "format",  "raw", "write as raw, pem or message")
+    nextCmd.Flags().Uint8Var(&next_version, "version",  0, "surface format version (default: version of <prev>)")
 
-    for i := 0; i < 16; i++ {
-        makeCmd.Flags().StringVar(&sf.Ingresses[i].Name, fmt.Sprintf("name%d",i),  "", fmt.Sprintf("domain name (%d)", i))
-        makeCmd.Flags().StringVar(&arg_identity[i], fmt.Sprintf("identity%d",i),  "", fmt.Sprintf("identity (%d)", i))
-        makeCmd.Flags().StringSliceVar(&arg_ips[i], fmt.Sprintf("ip%d",i),  []string{}, fmt.Sprintf("ip (%d)", i))
-        makeCmd.Flags().StringSliceVar(&arg_cert_file[i], fmt.Sprintf("cert-file%d",i),  []string{}, fmt.Sprintf("cert from file (%d)", i))
-    }
+    next_ingress.register(nextCmd)
 
-    rootCmd.AddCommand(makeCmd)
+    rootCmd.AddCommand(nextCmd)
 
 
-    rootCmd.AddCommand(&cobra.Command{
+    var dump_format string
+    dumpCmd := &cobra.Command{
         Use:        "dump <infile>",
-        Short:      "surface to json",
+        Short:      "surface to json, or another encoding",
         Args:       cobra.MinimumNArgs(1),
         Run: func(cmd *cobra.Command, args []string) {
-            f, err := ioutil.ReadFile(args[0])
-            if err != nil { panic(err) }
-            sf, err := surface.Parse(f);
-            if err != nil { panic(err) }
+            sf := loadSurface(args[0])
+
+            if typ, ok := sf.UnknownType(); ok {
+                fmt.Fprintf(os.Stderr, "stopped at unknown field type %d, %d bytes kept as they are\n", typ, len(sf.Unknown))
+            }
+
+            if dump_format != "json" {
+                f, err := surface.FormatFromString(dump_format)
+                if err != nil { panic(err) }
+                b, err := sf.Encode(f)
+                if err != nil { panic(err) }
+                os.Stdout.Write(b)
+                return
+            }
 
             e := json.NewEncoder(os.Stdout)
             e.SetIndent("", "  ")
             e.Encode(sf)
         },
+    }
+    dumpCmd.Flags().StringVar(&dump_format, "format",  "json", "json, raw, pem or message")
+    rootCmd.AddCommand(dumpCmd)
+
+
+    rootCmd.AddCommand(&cobra.Command{
+        Use:        "diff <a> <b>",
+        Short:      "show ingress changes between two surfaces",
+        Args:       cobra.MinimumNArgs(2),
+        Run: func(cmd *cobra.Command, args []string) {
+            a := loadSurface(args[0])
+            b := loadSurface(args[1])
+            for _, line := range surface.Diff(a, b) {
+                fmt.Println(line)
+            }
+        },
     })
 
+    var arg_prev string
+    validateCmd := &cobra.Command{
+        Use:        "validate <infile>",
+        Short:      "check that devices will accept a surface",
+        Args:       cobra.MinimumNArgs(1),
+        Run: func(cmd *cobra.Command, args []string) {
+            sf := loadSurface(args[0])
+
+            var prev *surface.Surface
+            if arg_prev != "" {
+                prev = loadSurface(arg_prev)
+            }
+
+            errs := sf.Validate(prev)
+            for _, err := range errs {
+                fmt.Fprintln(os.Stderr, err)
+            }
+            if len(errs) > 0 {
+                os.Exit(1)
+            }
+        },
+    }
+    validateCmd.Flags().StringVar(&arg_prev, "prev",  "", "the surface this one replaces. checks signature and precedent")
+    rootCmd.AddCommand(validateCmd)
+
+    rootCmd.AddCommand(&cobra.Command{
+        Use:        "lint <infile>",
+        Short:      "find mistakes in a surface",
+        Args:       cobra.MinimumNArgs(1),
+        Run: func(cmd *cobra.Command, args []string) {
+            sf := loadSurface(args[0])
+            warnings := sf.Lint()
+            for _, w := range warnings {
+                fmt.Fprintln(os.Stderr, w)
+            }
+            if len(warnings) > 0 {
+                os.Exit(1)
+            }
+        },
+    })
 
     return rootCmd
 }
+
+func loadSurface(path string) *surface.Surface {
+    f, err := ioutil.ReadFile(path)
+    if err != nil { panic(err) }
+    sf, err := surface.Decode(f);
+    if err != nil { panic(fmt.Errorf("%s: %w", path, err)) }
+    return sf
+}
+
+// a json or yaml description of a surface, depending on the file extension
+func loadSource(path string) *surface.Surface {
+    f, err := ioutil.ReadFile(path)
+    if err != nil { panic(err) }
+
+    var sf *surface.Surface
+    switch filepath.Ext(path) {
+        case ".yaml", ".yml":
+            sf, err = surface.FromYAML(f)
+        default:
+            sf, err = surface.FromJSON(f)
+    }
+    if err != nil { panic(fmt.Errorf("%s: %w", path, err)) }
+    return sf
+}
@@ -3,7 +3,6 @@ package main
 import (
     "github.com/spf13/cobra"
     "github.com/devguardio/carrier3/v3/surface"
-    "io/ioutil"
     "os"
     "github.com/go-chi/chi/v5"
     "github.com/go-chi/chi/v5/middleware"
@@ -15,6 +14,7 @@ import (
     "github.com/devguardio/carrier3/v3/cli"
     "time"
     "strings"
+    "fmt"
     log "github.com/sirupsen/logrus"
 )
 
@@ -31,6 +31,9 @@ func main() {
 
     var arg_disable_pty bool
     var arg_force_pty  bool
+    var arg_surface     string
+    var arg_broker      string
+    var arg_shell_e2e   bool
     shellCmd := &cobra.Command{
         Use:        "shell <identity> [cmd]",
         Short:      "connect to shell",
@@ -44,15 +47,28 @@ func main() {
             //  c += "'" + strings.ReplaceAll(arg, "'", "'\"'\"'") + "' "
             //}
             c := strings.Join(args[1:], " ")
-            code := cli.Shell(vault, args[0], c, arg_disable_pty, arg_force_pty)
+            if arg_surface != "" && arg_broker != "" {
+                panic("--surface and --broker can't be used together")
+            }
+
+            dialer := cli.ShellDialer(vault, arg_surface, arg_broker)
+            code := cli.Shell(dialer, args[0], c, arg_disable_pty, arg_force_pty, arg_shell_e2e)
             os.Exit(code)
         },
     }
     shellCmd.Flags().BoolVarP(&arg_disable_pty, "disable-pty",  "T", false, "Disable pseudo-terminal allocation")
     shellCmd.Flags().BoolVarP(&arg_force_pty, "force-pty",  "t", false, "Request pseudo-terminal allocation, even if stdio is not a terminal")
+    shellCmd.Flags().StringVar(&arg_surface, "surface",  "", "connect through the ingresses of this surface document, and keep it updated")
+    shellCmd.Flags().StringVar(&arg_broker, "broker",  "", "connect to this broker url, verified by the system roots (default " + cli.DefaultBroker + ")")
+    shellCmd.Flags().BoolVar(&arg_shell_e2e, "e2e", false, "talk tls to the device itself, so the broker can't read or impersonate. <identity> must be the device's")
     rootCmd.AddCommand(shellCmd)
 
     var arg_autoreg string
+    var arg_listeners int
+    var arg_mux bool
+    var arg_allow []string
+    var arg_allow_unproven bool
+    var arg_e2e string
     pubCmd := &cobra.Command{
         Use:        "publish <surface>",
         Short:      "a demo publisher",
@@ -61,10 +77,8 @@ func main() {
 
             vault := ik.Vault();
 
-            f, err := ioutil.ReadFile(args[0])
-            if err != nil { panic(err) }
-
-            sf, err := surface.Parse(f);
+            store := surface.NewFileStore(args[0])
+            sf, err := store.Load()
             if err != nil { panic(err) }
 
             if arg_autoreg != "" {
@@ -105,8 +119,38 @@ func main() {
             if err != nil { panic(err) }
             defer link.Close();
 
+            link.Updater = &surface.Updater{
+                OnUpdate: store.Save,
+            }
+            link.Clock = surface.DefaultClock
+            link.Listeners = arg_listeners
+            link.Mux = arg_mux
+
+            switch arg_e2e {
+                case "off":         link.E2E = carrier3.E2EOff
+                case "optional":    link.E2E = carrier3.E2EOptional
+                case "required":    link.E2E = carrier3.E2ERequired
+                default:
+                    panic(fmt.Errorf("--e2e: expected off, optional or required, got %s", arg_e2e))
+            }
+
+            if len(arg_allow) > 0 {
+                allow := carrier3.NewAllowList()
+                allow.AllowUnproven = arg_allow_unproven
+                for _, s := range arg_allow {
+                    id, err := ik.IdentityFromString(s)
+                    if err != nil { panic(fmt.Errorf("--allow %s: %w", s, err)) }
+                    allow.Add(*id)
+                }
+                link.Authorizer = allow
+            }
+            link.OnEvent = func(e carrier3.LinkEvent) {
+                log.WithFields(log.Fields{"ingress": e.Ingress, "seat": e.Seat, "delay": e.Delay}).Info("link ", e.Type)
+            }
+
             server := &http.Server{
-                Handler: r,
+                Handler:        r,
+                ConnContext:    carrier3.ConnContext,
             }
             err = server.Serve(link);
             if err != nil { panic(err) }
@@ -114,6 +158,11 @@ func main() {
         },
     }
     pubCmd.Flags().StringVar(&arg_autoreg, "autoreg",  "", "secret for auto registration")
+    pubCmd.Flags().IntVar(&arg_listeners, "listeners", 2, "idle listen connections to keep open at the broker, or mux connections with --mux. at least 1")
+    pubCmd.Flags().StringSliceVar(&arg_allow, "allow", nil, "only accept callers with this identity, proven with end to end tls. can be repeated")
+    pubCmd.Flags().BoolVar(&arg_allow_unproven, "allow-unproven", false, "with --allow, also take callers without end to end tls on the broker's word")
+    pubCmd.Flags().StringVar(&arg_e2e, "e2e", "optional", "end to end tls from callers: off, optional or required")
+    pubCmd.Flags().BoolVar(&arg_mux, "mux", false, "carry all callers over one connection per listener ("+carrier3.UpgradeMux+")")
     rootCmd.AddCommand(pubCmd)
 
     if err := rootCmd.Execute(); err != nil {
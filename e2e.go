@@ -0,0 +1,155 @@
+package carrier3
+
+import (
+    "github.com/devguardio/carrier3/v3/surface"
+    ik      "github.com/devguardio/identity/go"
+    iktls   "github.com/devguardio/identity/go/tls"
+    log     "github.com/sirupsen/logrus"
+
+    "crypto/tls"
+    "errors"
+    "fmt"
+    "net"
+    "time"
+)
+
+// E2EMode is whether callers talk tls to the device itself, inside the stream the broker hands over.
+// the caller then proves its vault identity directly to the device, so a broker can't impersonate it, and only sees ciphertext
+type E2EMode int
+
+const (
+    // streams are plaintext, CallerIdentity is what the broker claims
+    E2EOff E2EMode = iota
+    // callers that start tls are proven, others are taken on the broker's word
+    E2EOptional
+    // callers must start tls
+    E2ERequired
+)
+
+// the first byte of a tls handshake. a plaintext http request starts with a method name
+const tlsRecordHandshake = 0x16
+
+const e2eHandshakeTimeout = 10 * time.Second
+
+// secures, authorizes and hands a caller's stream to Accept, without holding up the listener it came from
+func (self *H1Link) accept(stream *H1Stream) {
+    secured, err := self.secure(stream)
+    if err == nil {
+        err = self.authorize(secured)
+    }
+    if errors.Is(err, ErrUnauthorized) {
+        log.Warn("rejecting reverse connection from ", stream.RemoteAddr(), ": ", err)
+        self.emit(LinkEvent{Type: LinkRejected, Caller: stream.RemoteAddr().String(), Err: err})
+        return
+    }
+    if err != nil { log.Error(err); return }
+    self.handoff(secured)
+}
+
+// asks the Authorizer about a secured stream, telling the caller why if it says no.
+// on error the stream is already closed
+func (self *H1Link) authorize(stream *H1Stream) error {
+    if self.Authorizer == nil { return nil }
+
+    err := self.Authorizer.Authorize(stream.CallerIdentity, stream.Proven, stream.connect)
+    if err == nil { return nil }
+    if !errors.Is(err, ErrUnauthorized) {
+        err = fmt.Errorf("%w: %v", ErrUnauthorized, err)
+    }
+    // inside the end to end tls if there is one, so the broker can't tell
+    reject(stream.Conn, err)
+    return err
+}
+
+// runs the end to end handshake if the caller starts one or E2E requires it.
+// on error the stream is already closed
+func (self *H1Link) secure(stream *H1Stream) (*H1Stream, error) {
+
+    if self.E2E == E2EOff {
+        return stream, nil
+    }
+
+    stream.SetDeadline(time.Now().Add(e2eHandshakeTimeout))
+
+    var first [1]byte
+    _, err := stream.Conn.Read(first[:])
+    if err != nil { stream.Close(); return nil, fmt.Errorf("waiting for caller: %w", err) }
+
+    peeked := &peekedConn{Conn: stream.Conn, first: first[:]}
+
+    if first[0] != tlsRecordHandshake {
+        if self.E2E == E2ERequired {
+            err = fmt.Errorf("%w: this device requires end to end tls", ErrUnauthorized)
+            reject(peeked, err)
+            return nil, err
+        }
+        stream.SetDeadline(time.Time{})
+        stream.Conn = peeked
+        return stream, nil
+    }
+
+    cert, err := surface.SelfCert(self.vault)
+    if err != nil { stream.Close(); return nil, err }
+
+    conn := tls.Server(peeked, &tls.Config{
+        MinVersion:             tls.VersionTLS13,
+        Certificates:           []tls.Certificate{cert},
+        ClientAuth:             tls.RequireAnyClientCert,
+        VerifyPeerCertificate:  iktls.VerifyPeerCertificate,
+    })
+    err = conn.Handshake()
+    if err != nil { conn.Close(); return nil, fmt.Errorf("%w: end to end tls: %v", ErrUnauthorized, err) }
+
+    state := conn.ConnectionState()
+    proven := iktls.ClaimedPeerIdentity(&state)
+
+    // the broker claimed someone else, so either it or the caller is lying
+    if stream.CallerIdentity == nil || !stream.CallerIdentity.Equal(&proven) {
+        err = fmt.Errorf("%w: caller proved to be %s, not %s as the broker claims", ErrUnauthorized, proven.String(), stream.RemoteAddr())
+        reject(conn, err)
+        return nil, err
+    }
+
+    stream.SetDeadline(time.Time{})
+    stream.Conn     = conn
+    stream.Proven   = true
+    return stream, nil
+}
+
+// E2EClient starts end to end tls with a device on a stream the broker relays,
+// proving the identity of vault and checking that the device is the expected one
+func E2EClient(conn net.Conn, vault ik.VaultI, device *ik.Identity) (*tls.Conn, error) {
+
+    cert, err := surface.SelfCert(vault)
+    if err != nil { return nil, err }
+
+    tconn := tls.Client(conn, &tls.Config{
+        MinVersion:             tls.VersionTLS13,
+        Certificates:           []tls.Certificate{cert},
+        // there is no ca, the device is checked by its identity
+        InsecureSkipVerify:     true,
+        VerifyPeerCertificate:  iktls.VerifyPeerIdentity(device),
+    })
+
+    conn.SetDeadline(time.Now().Add(e2eHandshakeTimeout))
+    err = tconn.Handshake()
+    if err != nil { tconn.Close(); return nil, fmt.Errorf("end to end tls with %s: %w", device.String(), err) }
+    conn.SetDeadline(time.Time{})
+
+    return tconn, nil
+}
+
+// a conn that already had its first bytes read
+type peekedConn struct {
+    net.Conn
+    first []byte
+}
+
+func (self *peekedConn) Read(p []byte) (int, error) {
+    if len(self.first) > 0 {
+        n := copy(p, self.first)
+        self.first = self.first[n:]
+        return n, nil
+    }
+    return self.Conn.Read(p)
+}
@@ -0,0 +1,142 @@
+package carrier3
+
+import (
+    ik  "github.com/devguardio/identity/go"
+    "testing"
+    "context"
+    "errors"
+    "net"
+    "net/http"
+    "io"
+    "io/ioutil"
+    "bufio"
+    "strings"
+)
+
+type secured struct {
+    stream  *H1Stream
+    err     error
+}
+
+// a stream the broker says is from claimed, secured by a link in mode
+func secureStream(t *testing.T, mode E2EMode, claimed *ik.Identity) (net.Conn, chan secured) {
+    link, err := Link(context.Background(), ik.Vault(), nil)
+    if err != nil { t.Fatal(err) }
+    t.Cleanup(func() { link.Close() })
+    link.E2E = mode
+
+    dev, caller := net.Pipe()
+    t.Cleanup(func() { caller.Close() })
+
+    me, _ := ik.Vault().Identity()
+    done := make(chan secured, 1)
+    go func() {
+        stream, err := link.secure(&H1Stream{Conn: dev, CallerIdentity: claimed, MyIdentity: me})
+        done <- secured{stream, err}
+    }()
+    return caller, done
+}
+
+// the 403 a rejected caller reads, up to the device closing the stream
+func rejection(t *testing.T, conn io.Reader) string {
+    bio := bufio.NewReader(conn)
+    resp, err := http.ReadResponse(bio, nil)
+    if err != nil { t.Fatal(err) }
+    body, _ := ioutil.ReadAll(resp.Body)
+    if resp.StatusCode != http.StatusForbidden {
+        t.Fatalf("expected 403, got %s", resp.Status)
+    }
+    io.Copy(ioutil.Discard, bio)
+    return string(body)
+}
+
+func TestE2EProven(t *testing.T) {
+
+    me, err := ik.Vault().Identity()
+    if err != nil { t.Fatal(err) }
+
+    caller, done := secureStream(t, E2ERequired, me)
+
+    conn, err := E2EClient(caller, ik.Vault(), me)
+    if err != nil { t.Fatal(err) }
+
+    s := <- done
+    if s.err != nil { t.Fatal(s.err) }
+    if !s.stream.Proven {
+        t.Fatal("stream not proven")
+    }
+    addr := s.stream.RemoteAddr().(GoNetCarrierAddr)
+    if !addr.Proven() || !addr.Identity().Equal(me) {
+        t.Fatalf("remote addr %v doesn't say proven", addr)
+    }
+    if got := StreamFromContext(ConnContext(context.Background(), s.stream)); got != s.stream {
+        t.Fatal("stream not in connection context")
+    }
+
+    go conn.Write([]byte("hello"))
+    var b [5]byte
+    _, err = io.ReadFull(s.stream, b[:])
+    if err != nil || string(b[:]) != "hello" {
+        t.Fatalf("read %q %v", b, err)
+    }
+}
+
+func TestE2EIdentityMismatch(t *testing.T) {
+
+    me, err := ik.Vault().Identity()
+    if err != nil { t.Fatal(err) }
+    var other ik.Identity
+    other[0] = 1
+
+    // the broker claims someone else than who shows up
+    caller, done := secureStream(t, E2EOptional, &other)
+
+    conn, err := E2EClient(caller, ik.Vault(), me)
+    if err != nil { t.Fatal(err) }
+    if reason := rejection(t, conn); !strings.Contains(reason, "not " + other.String()) {
+        t.Fatalf("rejected with %s", reason)
+    }
+    if s := <- done; !errors.Is(s.err, ErrUnauthorized) {
+        t.Fatalf("expected unauthorized, got %v", s.err)
+    }
+
+    // a device that isn't the one the caller wanted
+    caller, done = secureStream(t, E2EOptional, me)
+    _, err = E2EClient(caller, ik.Vault(), &other)
+    if err == nil {
+        t.Fatal("connected to the wrong device")
+    }
+    if s := <- done; !errors.Is(s.err, ErrUnauthorized) {
+        t.Fatalf("expected unauthorized, got %v", s.err)
+    }
+}
+
+func TestE2EPlaintext(t *testing.T) {
+
+    me, err := ik.Vault().Identity()
+    if err != nil { t.Fatal(err) }
+    const request = "GET / HTTP/1.1\r\nHost: device\r\n\r\n"
+
+    caller, done := secureStream(t, E2ERequired, me)
+    go io.WriteString(caller, request)
+    if reason := rejection(t, caller); !strings.Contains(reason, "requires end to end tls") {
+        t.Fatalf("rejected with %s", reason)
+    }
+    if s := <- done; !errors.Is(s.err, ErrUnauthorized) {
+        t.Fatalf("expected unauthorized, got %v", s.err)
+    }
+
+    // taken on the broker's word, without losing the byte that was peeked at
+    caller, done = secureStream(t, E2EOptional, me)
+    go io.WriteString(caller, request)
+    s := <- done
+    if s.err != nil { t.Fatal(s.err) }
+    if s.stream.Proven || s.stream.RemoteAddr().(GoNetCarrierAddr).Proven() {
+        t.Fatal("plaintext stream proven")
+    }
+    req, err := http.ReadRequest(bufio.NewReader(s.stream))
+    if err != nil { t.Fatal(err) }
+    if req.Method != "GET" {
+        t.Fatalf("read %s", req.Method)
+    }
+}
@@ -4,10 +4,12 @@ go 1.17
 
 require (
 	github.com/creack/pty v1.1.17
+	github.com/deepmap/oapi-codegen v1.9.1
 	github.com/devguardio/identity/go v0.0.0-20220214220023-621b06891026
 	github.com/dustin/go-humanize v1.0.0
 	github.com/fatih/color v1.13.0
 	github.com/getkin/kin-openapi v0.89.0
+	github.com/ghodss/yaml v1.0.0
 	github.com/go-chi/chi/v5 v5.0.7
 	github.com/go-chi/render v1.0.1
 	github.com/go-redis/redis/v8 v8.11.4
@@ -26,9 +28,7 @@ require (
 
 require (
 	github.com/cespare/xxhash/v2 v2.1.2 // indirect
-	github.com/deepmap/oapi-codegen v1.9.1 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
-	github.com/ghodss/yaml v1.0.0 // indirect
 	github.com/go-daq/crc8 v0.0.0-20170116120732-380c22547098 // indirect
 	github.com/go-openapi/jsonpointer v0.19.5 // indirect
 	github.com/go-openapi/swag v0.19.5 // indirect
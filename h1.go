@@ -13,73 +13,369 @@ import (
     "io"
     "fmt"
     "bufio"
+    "net/textproto"
     "encoding/binary"
     "strings"
     "time"
+    "sync"
+    "errors"
+    "math/rand"
 )
 
 func Link(ctx context.Context, vault ik.VaultI, sf *surface.Surface) (*H1Link, error) {
+    ctx, cancel := context.WithCancel(ctx)
     return &H1Link {
         vault:  vault,
         sf:     sf,
         ctx:    ctx,
+        cancel: cancel,
+        accepted:   make(chan net.Conn),
+        Health:     surface.NewHealth(),
+        Resolver:   surface.NewCachingResolver(net.DefaultResolver),
     }, nil
 }
 
+type LinkEventType int
+
+const (
+    // the broker accepted the listen connection for the first time
+    LinkConnected LinkEventType = iota + 1
+    // the last listen connection the broker had registered failed
+    LinkDisconnected
+    // waiting Delay before the next attempt
+    LinkBackoff
+    // the broker accepted the listen connection again after the link was down
+    LinkReregistered
+    // a caller was turned away, see Authorizer
+    LinkRejected
+)
+
+func (self LinkEventType) String() string {
+    switch self {
+        case LinkConnected:     return "connected"
+        case LinkDisconnected:  return "disconnected"
+        case LinkBackoff:       return "backoff"
+        case LinkReregistered:  return "reregistered"
+        case LinkRejected:      return "rejected"
+    }
+    return fmt.Sprintf("LinkEventType(%d)", int(self))
+}
+
+type LinkEvent struct {
+    Type        LinkEventType
+
+    // the ingress of the listen connection, if one was reached
+    Ingress     string
+
+    // the seat the broker assigned, if it said so
+    Seat        string
+
+    // the caller the broker claimed, for LinkRejected
+    Caller      string
+
+    // why the link went down or is backing off
+    Err         error
+
+    // consecutive failed attempts, and how long until the next one
+    Failures    int
+    Delay       time.Duration
+}
+
+// jitter spreads out reconnecting devices, so a broker restart doesn't bring them all back at once
+var jitterMu    sync.Mutex
+var jitterRand  = rand.New(rand.NewSource(time.Now().UnixNano()))
+
 type H1Link struct {
     ctx     context.Context
+    cancel  context.CancelFunc
     vault   ik.VaultI
     sf      *surface.Surface
+
+    // listen connections that a caller arrived on, waiting for Accept
+    accepted    chan net.Conn
+    start       sync.Once
+
+    // link state, shared by all listeners
+    mu          sync.Mutex
+    up          bool
+    wasUp       bool
+    // listen connections the broker currently has registered
+    live        int
+    // the broker refused UpgradeMux
+    noMux       bool
+
+    // store one update at a time, even when several listeners fetch the same successor
+    updateMu    sync.Mutex
+    // the highest serial passed to Updater.OnUpdate
+    saved       ik.Serial
+
+    // replaces dialing the surface, for tests
+    dial        func(ctx context.Context) (net.Conn, *surface.Ingress, error)
+
+    // fetch newer surface documents on every connection
+    Updater *surface.Updater
+
+    // check ingress certificates against this clock and sync it on every connection
+    Clock   *surface.Clock
+
+    // which ingresses worked, kept across connections
+    Health  *surface.Health
+
+    // looks up ingress names. the default keeps the last good answers in case dns goes down
+    Resolver surface.Resolver
+
+    // wait after the first failed attempt, doubling with every further failure up to MaxBackoff.
+    // defaults to 1 second and 5 minutes. the actual wait is randomly between half and all of it
+    MinBackoff  time.Duration
+    MaxBackoff  time.Duration
+
+    // called on link state changes. must not block
+    OnEvent     func(LinkEvent)
+
+    // how many idle listen connections to keep open at the broker, so that concurrent callers
+    // don't wait for each other's handshake. each one is redialed as soon as a caller took it.
+    // with Mux, how many mux connections to keep open. zero means 1, a single listen connection like before there was a pool
+    Listeners   int
+
+    // decides which callers may open streams, after E2E had its say. nil accepts every caller the broker names
+    Authorizer  Authorizer
+
+    // whether callers must, may or can't talk tls to the device inside their stream. see E2EMode
+    E2E         E2EMode
+
+    // carry all callers over one long lived connection per listener instead of one connection per caller.
+    // falls back to UpgradeCast if the broker doesn't know UpgradeMux
+    Mux         bool
 }
 
+// the upgrade protocols of CONNECT /v1/listen
+const UpgradeCast   = "carrier3-cast"
+const UpgradeMux    = "carrier3-mux"
+
+var errNoMux = errors.New("broker refused " + UpgradeMux)
+
+// Close stops Accept and closes the idle listen connections
 func (self *H1Link) Close() error {
+    self.cancel()
     return nil
 }
 
+func (self *H1Link) emit(e LinkEvent) {
+    if self.OnEvent != nil {
+        self.OnEvent(e)
+    }
+}
+
+func (self *H1Link) backoff(failures int) time.Duration {
+    var min = self.MinBackoff
+    if min == 0 {
+        min = time.Second
+    }
+    var max = self.MaxBackoff
+    if max == 0 {
+        max = 5 * time.Minute
+    }
+
+    var delay = min
+    for i := 1; i < failures && delay < max; i++ {
+        delay *= 2
+    }
+    if delay > max {
+        delay = max
+    }
+
+    jitterMu.Lock()
+    defer jitterMu.Unlock()
+    return delay / 2 + time.Duration(jitterRand.Int63n(int64(delay / 2) + 1))
+}
+
 func (self *H1Link) Addr() net.Addr {
     return nil
 }
 
-func (self *H1Link) acceptOnce() (net.Conn, error) {
+// dials the first usable ingress of the surface, picking up surface updates on the way
+func (self *H1Link) dialIngress() (net.Conn, *surface.Ingress, error) {
 
-    selfid, _ := self.vault.Identity();
+    if self.dial != nil {
+        return self.dial(self.ctx)
+    }
 
+    self.mu.Lock()
     dialer := surface.NewDialer(self.vault, self.sf);
+    self.mu.Unlock()
+
+    if self.Updater != nil && self.Updater.OnUpdate != nil {
+        updater := *self.Updater
+        updater.OnUpdate = self.saveUpdate
+        dialer.Updater = &updater
+    } else {
+        dialer.Updater = self.Updater
+    }
+    dialer.Clock   = self.Clock
+    dialer.Health  = self.Health
+    dialer.Resolver = self.Resolver
     conn, ingress, err := dialer.DialContext(self.ctx)
-    if err != nil { return nil, err }
+
+    // another listener may have updated further in the meantime
+    self.mu.Lock()
+    if dialer.Surface.Serial > self.sf.Serial {
+        self.sf = dialer.Surface
+    }
+    self.mu.Unlock()
+
+    if err != nil { return nil, nil, err }
+    return conn, ingress, nil
+}
+
+// passes doc to Updater.OnUpdate unless a listener walking the chain at the same time already did,
+// or got further. saving it again would fail as a rollback and throw away this listener's connection
+func (self *H1Link) saveUpdate(doc *surface.Surface) error {
+    self.updateMu.Lock()
+    defer self.updateMu.Unlock()
+
+    if doc.Serial <= self.saved {
+        return nil
+    }
+    err := self.Updater.OnUpdate(doc)
+    if err != nil { return err }
+    self.saved = doc.Serial
+    return nil
+}
+
+// dials an ingress and asks the broker to register a listen connection with the given upgrade protocol
+func (self *H1Link) register(upgrade string) (net.Conn, *surface.Ingress, string, error) {
+
+    conn, ingress, err := self.dialIngress()
+    if err != nil { return nil, nil, "", err }
 
     conn.Write([]byte(fmt.Sprintf(
         "CONNECT /v1/listen HTTP/1.1\r\n"+
-        "Upgrade: carrier3-cast\r\n"+
+        "Upgrade: %s\r\n"+
         "Connection: Upgrade\r\n"+
-        "Host: %s\r\n\r\n", ingress.Name)))
+        "Host: %s\r\n\r\n", upgrade, ingress.Host())))
 
     // read http1 upgrade response
 
     bio := bufio.NewReader(conn)
     line ,_, err := bio.ReadLine()
-    if err != nil { conn.Close(); return nil, err }
+    if err != nil { conn.Close(); return nil, nil, "", err }
     lines := strings.Split(string(line), " ")
     if len(lines) < 3 || lines[1] != "101" {
-        return nil, fmt.Errorf("response: %s", line)
+        defer conn.Close()
+        if len(lines) >= 2 && upgrade == UpgradeMux && muxUnsupported(lines[1], bio) {
+            return nil, nil, "", fmt.Errorf("%w: %s", errNoMux, line)
+        }
+        return nil, nil, "", fmt.Errorf("response: %s", line)
     }
 
+    var seat string
     for ;; {
         line ,_, err := bio.ReadLine()
-        if err != nil { conn.Close(); return nil, err }
+        if err != nil { conn.Close(); return nil, nil, "", err }
         if len(line) == 0 { break }
         log.Println(string(line))
         split := strings.Split(string(line), ":")
         if len(split) == 2 && split[0] == "Seat" {
+            seat = strings.TrimSpace(split[1])
         }
     }
 
     if bio.Buffered() != 0 {
         // can't be bothered to implement this. it propably never happens anyway
-        return nil, fmt.Errorf("race. body after connect arrived too early")
+        conn.Close()
+        return nil, nil, "", fmt.Errorf("race. body after connect arrived too early")
     }
 
-    // idle waiting for reverse conn
+    return conn, ingress, seat, nil
+}
+
+// whether the broker's answer to UpgradeMux means it doesn't know it at all.
+// anything else, like a 401 or 429, is only this attempt failing, and the next one asks for UpgradeMux again
+func muxUnsupported(status string, bio *bufio.Reader) bool {
+    if status != "400" && status != "404" && status != "426" {
+        return false
+    }
+    header, err := textproto.NewReader(bio).ReadMIMEHeader()
+    if err != nil { return false }
+    for _, v := range header.Values("Upgrade") {
+        for _, proto := range strings.Split(v, ",") {
+            if strings.EqualFold(strings.TrimSpace(proto), UpgradeMux) {
+                return false
+            }
+        }
+    }
+    return true
+}
+
+// marks a listen connection as registered at the broker until the returned func is called
+func (self *H1Link) registered(ingress *surface.Ingress, seat string) func() {
+    self.mu.Lock()
+    defer self.mu.Unlock()
+
+    self.live += 1
+    if !self.up {
+        self.up = true
+        if self.wasUp {
+            self.emit(LinkEvent{Type: LinkReregistered, Ingress: ingress.Host(), Seat: seat})
+        } else {
+            self.emit(LinkEvent{Type: LinkConnected, Ingress: ingress.Host(), Seat: seat})
+        }
+        self.wasUp = true
+    }
+
+    return func() {
+        self.mu.Lock()
+        self.live -= 1
+        self.mu.Unlock()
+    }
+}
+
+// closes conn when the link is closed, until the returned func is called
+func (self *H1Link) closeOnDone(conn net.Conn) func() {
+    waiting := make(chan struct{})
+    go func() {
+        select {
+            case <- self.ctx.Done():
+                conn.Close()
+            case <- waiting:
+        }
+    }()
+    return func() { close(waiting) }
+}
+
+// the stream for a caller, from the json headers the broker sent ahead of it
+func (self *H1Link) stream(conn net.Conn, headerbytes []byte) (*H1Stream, error) {
+
+    var brokerHeaders api.Connect
+    err := json.Unmarshal(headerbytes, &brokerHeaders)
+    if err != nil { return nil, fmt.Errorf("parse broker headers: %w", err) }
+
+    // the Authorizer only gets to decide once secure knows whether the caller proved this
+    caller, err := ik.IdentityFromString(brokerHeaders.Caller)
+    if err != nil {
+        err = fmt.Errorf("%w: invalid caller identity '%s': %v", ErrUnauthorized, brokerHeaders.Caller, err)
+        log.Warn("rejecting reverse connection from ", brokerHeaders.Caller, ": ", err)
+        self.emit(LinkEvent{Type: LinkRejected, Caller: brokerHeaders.Caller, Err: err})
+        return nil, err
+    }
+
+    log.Println("accepting reverse connection from", brokerHeaders.Caller);
+    selfid, _ := self.vault.Identity();
+
+    return &H1Stream{
+        Conn:               conn,
+        CallerIdentity:     caller,
+        MyIdentity:         selfid,
+        connect:            &brokerHeaders,
+    }, nil
+}
+
+// idles on a carrier3-cast listen connection until the broker hands it a caller
+func (self *H1Link) awaitCaller(conn net.Conn) (*H1Stream, error) {
+
+    // the read below doesn't know about the context
+    defer self.closeOnDone(conn)()
+
     log.Println("awaiting reverse connection");
     var b [1]byte
     for ;; {
@@ -94,47 +390,136 @@ func (self *H1Link) acceptOnce() (net.Conn, error) {
             _, err = io.ReadFull(conn, headerbytes)
             if err != nil { conn.Close(); return nil, fmt.Errorf("read broker headers: %w", err) }
 
-            var brokerHeaders api.Connect
-            err = json.Unmarshal(headerbytes, &brokerHeaders)
-            if err != nil { conn.Close(); return nil, fmt.Errorf("parse broker headers: %w", err) }
-
-            //TODO auth
-            log.Println("accepting reverse connection from", brokerHeaders.Caller);
-            caller, _  := ik.IdentityFromString(brokerHeaders.Caller)
-
-            return &H1Stream{
-                Conn:               conn,
-                CallerIdentity:     caller,
-                MyIdentity:         selfid,
-            }, nil
+            stream, err := self.stream(conn, headerbytes)
+            if errors.Is(err, ErrUnauthorized) {
+                // the listen connection is used up, but the link is fine
+                reject(conn, err)
+                return nil, nil
+            }
+            if err != nil { conn.Close(); return nil, err }
+            return stream, nil
         } else if b[0] == 0x01 {
             conn.Write([]byte{0x02})
         }
     }
 }
 
+// tells a rejected caller why, as http response on the stream
+func reject(conn net.Conn, reason error) {
+    body := reason.Error() + "\n"
+    conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+    conn.Write([]byte(fmt.Sprintf(
+        "HTTP/1.1 403 Forbidden\r\n"+
+        "Content-Type: text/plain; charset=utf-8\r\n"+
+        "Content-Length: %d\r\n"+
+        "Connection: close\r\n\r\n%s", len(body), body)))
+    conn.Close()
+}
+
+// hands a stream to Accept, or closes it if the link is closed first
+func (self *H1Link) handoff(c net.Conn) {
+    select {
+        case self.accepted <- c:
+        case <- self.ctx.Done():
+            c.Close()
+    }
+}
 
 func (self *H1Link) Accept() (net.Conn, error) {
+    self.start.Do(func() {
+        n := self.Listeners
+        if n < 1 {
+            n = 1
+        }
+        for i := 0; i < n; i++ {
+            go self.listen()
+        }
+    })
+
+    select {
+        case c := <- self.accepted:
+            return c, nil
+        case <- self.ctx.Done():
+            return nil, fmt.Errorf("canceled: %w", self.ctx.Err());
+    }
+}
+
+// keeps one listen connection open at the broker until the link is closed
+func (self *H1Link) listen() {
+    var failures = 0
     for ;; {
-        c, err := self.acceptOnce()
 
-        select {
-            case <- self.ctx.Done():
-                return nil, fmt.Errorf("canceled");
-            default:
+        var upgrade = UpgradeCast
+        self.mu.Lock()
+        if self.Mux && !self.noMux {
+            upgrade = UpgradeMux
+        }
+        self.mu.Unlock()
+
+        conn, ingress, seat, err := self.register(upgrade)
+        if err == nil {
+            failures = 0
+            unregister := self.registered(ingress, seat)
+
+            if upgrade == UpgradeMux {
+                err = self.serveMux(conn)
+            } else {
+                var c *H1Stream
+                c, err = self.awaitCaller(conn)
+                if err == nil && c != nil {
+                    go self.accept(c)
+                }
+            }
+            unregister()
+        }
+
+        if self.ctx.Err() != nil {
+            return
+        }
+        if err == nil {
+            continue
         }
 
-        if err != nil {
-            log.Error(err);
-            time.Sleep(5 * time.Second);
+        log.Error(err);
+
+        if errors.Is(err, errNoMux) {
+            log.Warn("broker does not support ", UpgradeMux, ", falling back to ", UpgradeCast)
+            self.mu.Lock()
+            self.noMux = true
+            self.mu.Unlock()
             continue
         }
-        return c, nil
+
+        self.mu.Lock()
+        // the link is only down once no other listener is still registered
+        if self.up && self.live == 0 {
+            self.up = false
+            self.emit(LinkEvent{Type: LinkDisconnected, Err: err})
+        }
+        self.mu.Unlock()
+
+        failures += 1
+        delay := self.backoff(failures)
+        self.emit(LinkEvent{Type: LinkBackoff, Err: err, Failures: failures, Delay: delay})
+
+        timer := time.NewTimer(delay)
+        select {
+            case <- self.ctx.Done():
+                timer.Stop()
+                return
+            case <- timer.C:
+        }
     }
 }
 
-type GoNetCarrierAddr struct {id*ik.Identity}
+type GoNetCarrierAddr struct {
+    id      *ik.Identity
+    proven  bool
+}
 func (self GoNetCarrierAddr) Network() string {return "carrier" }
+func (self GoNetCarrierAddr) Identity() *ik.Identity { return self.id }
+// the identity was proven with end to end tls, rather than claimed by the broker
+func (self GoNetCarrierAddr) Proven() bool { return self.proven }
 func (self GoNetCarrierAddr) String() string  {
     if self.id == nil {
         return "<anon>"
@@ -145,6 +530,12 @@ type H1Stream struct {
     CallerIdentity  *ik.Identity
     MyIdentity      *ik.Identity
     Conn            net.Conn
+
+    // CallerIdentity was proven with end to end tls, rather than claimed by the broker
+    Proven          bool
+
+    // what the broker sent ahead of the stream, for the Authorizer
+    connect         *api.Connect
 }
 func (self *H1Stream) Close() error {
     log.Println("H1 STREAM CLOSED")
@@ -166,8 +557,25 @@ func (self *H1Stream) Write(p []byte) (int, error) {
     return self.Conn.Write(p)
 }
 func (self *H1Stream) RemoteAddr() net.Addr {
-    return GoNetCarrierAddr{self.CallerIdentity}
+    return GoNetCarrierAddr{id: self.CallerIdentity, proven: self.Proven}
 }
 func (self *H1Stream) LocalAddr() net.Addr {
-    return GoNetCarrierAddr{self.MyIdentity}
+    return GoNetCarrierAddr{id: self.MyIdentity}
+}
+
+type streamContextKey struct{}
+
+// ConnContext is meant for http.Server.ConnContext, so that handlers can get at their caller with StreamFromContext.
+// http.Request.RemoteAddr is only the caller's identity as string
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+    if stream, ok := c.(*H1Stream); ok {
+        return context.WithValue(ctx, streamContextKey{}, stream)
+    }
+    return ctx
+}
+
+// StreamFromContext returns the stream a request arrived on, or nil if the server doesn't set ConnContext
+func StreamFromContext(ctx context.Context) *H1Stream {
+    stream, _ := ctx.Value(streamContextKey{}).(*H1Stream)
+    return stream
 }
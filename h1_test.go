@@ -0,0 +1,366 @@
+package carrier3
+
+import (
+    "github.com/devguardio/carrier3/v3/surface"
+    ik  "github.com/devguardio/identity/go"
+    "testing"
+    "context"
+    "encoding/binary"
+    "encoding/json"
+    "net"
+    "net/http"
+    "bufio"
+    "fmt"
+    "time"
+)
+
+// a link whose dials are pipes. the broker end of each one is sent to the test
+func pipeLink(t *testing.T) (*H1Link, chan net.Conn) {
+    link, err := Link(context.Background(), ik.Vault(), &surface.Surface{Serial: 1})
+    if err != nil { t.Fatal(err) }
+    t.Cleanup(func() { link.Close() })
+
+    brokers := make(chan net.Conn)
+    link.dial = func(ctx context.Context) (net.Conn, *surface.Ingress, error) {
+        dev, brk := net.Pipe()
+        select {
+            case brokers <- brk:
+                return dev, &surface.Ingress{Name: "ingress.test"}, nil
+            case <- ctx.Done():
+                return nil, nil, ctx.Err()
+        }
+    }
+    return link, brokers
+}
+
+// the broker side of registering a listen connection. returns the upgrade protocol the device asked for
+func fakeRegister(t *testing.T, conn net.Conn, seat string) string {
+    req, err := http.ReadRequest(bufio.NewReader(conn))
+    if err != nil { t.Fatal(err) }
+    if req.Method != "CONNECT" || req.URL.Path != "/v1/listen" {
+        t.Fatalf("unexpected register request %s %s", req.Method, req.URL)
+    }
+    _, err = fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: %s\r\nSeat: %s\r\n\r\n", req.Header.Get("Upgrade"), seat)
+    if err != nil { t.Fatal(err) }
+    return req.Header.Get("Upgrade")
+}
+
+// the broker handing a caller to an idle carrier3-cast listen connection
+func fakeCaller(t *testing.T, conn net.Conn, caller string) {
+    js, err := json.Marshal(map[string]string{"Caller": caller})
+    if err != nil { t.Fatal(err) }
+    var hdr [3]byte
+    hdr[0] = 0xff
+    binary.LittleEndian.PutUint16(hdr[1:], uint16(len(js)))
+    _, err = conn.Write(append(hdr[:], js...))
+    if err != nil { t.Fatal(err) }
+}
+
+func nextEvent(t *testing.T, events chan LinkEvent) LinkEvent {
+    select {
+        case e := <- events:
+            return e
+        case <- time.After(5 * time.Second):
+            t.Fatal("no link event")
+    }
+    return LinkEvent{}
+}
+
+func TestLinkBackoff(t *testing.T) {
+
+    link := &H1Link{MinBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+
+    for failures, max := range map[int]time.Duration{
+        1:  100 * time.Millisecond,
+        2:  200 * time.Millisecond,
+        4:  800 * time.Millisecond,
+        5:  time.Second,
+        50: time.Second,
+    } {
+        var min, most = max, time.Duration(0)
+        for i := 0; i < 1000; i++ {
+            d := link.backoff(failures)
+            if d < max / 2 || d > max {
+                t.Fatalf("backoff after %d failures is %v, expected %v to %v", failures, d, max / 2, max)
+            }
+            if d < min { min = d }
+            if d > most { most = d }
+        }
+        // all devices waiting the same time is what the jitter is for
+        if most - min < max / 4 {
+            t.Fatalf("backoff after %d failures hardly varies: %v to %v", failures, min, most)
+        }
+    }
+
+    var defaults H1Link
+    if d := defaults.backoff(1); d < 500 * time.Millisecond || d > time.Second {
+        t.Fatalf("default first backoff is %v", d)
+    }
+    if d := defaults.backoff(100); d < 150 * time.Second || d > 5 * time.Minute {
+        t.Fatalf("default backoff cap is %v", d)
+    }
+}
+
+func TestLinkEvents(t *testing.T) {
+
+    link, brokers := pipeLink(t)
+    link.MinBackoff = time.Millisecond
+    link.MaxBackoff = 2 * time.Millisecond
+
+    events := make(chan LinkEvent, 16)
+    link.OnEvent = func(e LinkEvent) { events <- e }
+
+    me, err := ik.Vault().Identity()
+    if err != nil { t.Fatal(err) }
+
+    type accepted struct {
+        conn    net.Conn
+        err     error
+    }
+    acc := make(chan accepted, 1)
+    go func() {
+        c, err := link.Accept()
+        acc <- accepted{c, err}
+    }()
+
+    // registers, then the broker goes away
+    brk := <- brokers
+    fakeRegister(t, brk, "3")
+    if e := nextEvent(t, events); e.Type != LinkConnected || e.Seat != "3" || e.Ingress != "ingress.test" {
+        t.Fatalf("expected connected to seat 3, got %+v", e)
+    }
+    brk.Close()
+    if e := nextEvent(t, events); e.Type != LinkDisconnected || e.Err == nil {
+        t.Fatalf("expected disconnected, got %+v", e)
+    }
+    if e := nextEvent(t, events); e.Type != LinkBackoff || e.Failures != 1 || e.Delay <= 0 {
+        t.Fatalf("expected first backoff, got %+v", e)
+    }
+
+    // still down
+    brk = <- brokers
+    brk.Close()
+    if e := nextEvent(t, events); e.Type != LinkBackoff || e.Failures != 2 {
+        t.Fatalf("expected second backoff, got %+v", e)
+    }
+
+    // back, and a caller arrives
+    brk = <- brokers
+    fakeRegister(t, brk, "4")
+    if e := nextEvent(t, events); e.Type != LinkReregistered || e.Seat != "4" {
+        t.Fatalf("expected reregistered to seat 4, got %+v", e)
+    }
+    fakeCaller(t, brk, me.String())
+
+    a := <- acc
+    if a.err != nil { t.Fatal(a.err) }
+    if s, ok := a.conn.(*H1Stream); !ok || !s.CallerIdentity.Equal(me) {
+        t.Fatalf("accepted %#v", a.conn)
+    }
+
+    // handing off a caller doesn't take the link down
+    <- brokers
+    select {
+        case e := <- events:
+            t.Fatalf("unexpected event %+v", e)
+        default:
+    }
+
+    link.Close()
+    if _, err := link.Accept(); err == nil {
+        t.Fatal("accepted on a closed link")
+    }
+}
+
+func TestLinkCloseDuringBackoff(t *testing.T) {
+
+    link, brokers := pipeLink(t)
+    link.MinBackoff = time.Hour
+    link.MaxBackoff = 2 * time.Hour
+
+    events := make(chan LinkEvent, 16)
+    link.OnEvent = func(e LinkEvent) { events <- e }
+
+    done := make(chan struct{})
+    go func() {
+        link.listen()
+        close(done)
+    }()
+
+    brk := <- brokers
+    brk.Close()
+    if e := nextEvent(t, events); e.Type != LinkBackoff || e.Delay < 30 * time.Minute {
+        t.Fatalf("expected a long backoff, got %+v", e)
+    }
+
+    link.Close()
+    select {
+        case <- done:
+        case <- time.After(5 * time.Second):
+            t.Fatal("listener kept waiting after close")
+    }
+}
+
+func TestLinkCloseWhileIdle(t *testing.T) {
+
+    link, brokers := pipeLink(t)
+
+    done := make(chan struct{})
+    go func() {
+        link.listen()
+        close(done)
+    }()
+
+    fakeRegister(t, <- brokers, "1")
+
+    link.Close()
+    select {
+        case <- done:
+        case <- time.After(5 * time.Second):
+            t.Fatal("idle listen connection kept waiting after close")
+    }
+}
+
+func TestLinkListeners(t *testing.T) {
+
+    link, brokers := pipeLink(t)
+    link.Listeners  = 3
+    link.MinBackoff = time.Millisecond
+    link.MaxBackoff = 2 * time.Millisecond
+
+    events := make(chan LinkEvent, 16)
+    link.OnEvent = func(e LinkEvent) { events <- e }
+
+    me, err := ik.Vault().Identity()
+    if err != nil { t.Fatal(err) }
+
+    acc := make(chan net.Conn, 1)
+    go func() {
+        c, err := link.Accept()
+        if err != nil { t.Error(err) }
+        acc <- c
+    }()
+
+    var idle []net.Conn
+    for i := 0; i < 3; i++ {
+        brk := <- brokers
+        if upgrade := fakeRegister(t, brk, fmt.Sprint(i)); upgrade != UpgradeCast {
+            t.Fatalf("listener asked for %s", upgrade)
+        }
+        idle = append(idle, brk)
+    }
+    if e := nextEvent(t, events); e.Type != LinkConnected {
+        t.Fatalf("expected connected, got %+v", e)
+    }
+
+    // a caller takes one, and it is replaced
+    fakeCaller(t, idle[0], me.String())
+    select {
+        case <- acc:
+        case <- time.After(5 * time.Second):
+            t.Fatal("caller not accepted")
+    }
+    fakeRegister(t, <- brokers, "3")
+
+    // losing one of several isn't the link going down
+    idle[1].Close()
+    if e := nextEvent(t, events); e.Type != LinkBackoff {
+        t.Fatalf("expected backoff, got %+v", e)
+    }
+    fakeRegister(t, <- brokers, "4")
+
+    select {
+        case e := <- events:
+            t.Fatalf("unexpected event %+v", e)
+        case <- time.After(50 * time.Millisecond):
+    }
+}
+
+func TestLinkConcurrentUpdates(t *testing.T) {
+
+    store := surface.NewFileStore(t.TempDir() + "/surface")
+    link  := &H1Link{Updater: &surface.Updater{OnUpdate: store.Save}}
+
+    // two listeners walking the same chain, one of them a step behind
+    var chain []*surface.Surface
+    for serial := 2; serial < 40; serial++ {
+        chain = append(chain, &surface.Surface{Serial: ik.Serial(serial), Precedent: ik.Serial(serial - 1)})
+    }
+    errs := make(chan error, 2)
+    for i := 0; i < 2; i++ {
+        go func() {
+            for _, doc := range chain {
+                err := link.saveUpdate(doc)
+                if err != nil { errs <- err; return }
+            }
+            errs <- nil
+        }()
+    }
+    for i := 0; i < 2; i++ {
+        if err := <- errs; err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    doc, err := store.Load()
+    if err != nil { t.Fatal(err) }
+    if doc.Serial != 39 {
+        t.Fatalf("stored serial %d", doc.Serial)
+    }
+
+    // and one that is behind by more than a step
+    err = link.saveUpdate(chain[3])
+    if err != nil { t.Fatal(err) }
+
+    // failed saves are retried
+    var calls = 0
+    link.Updater.OnUpdate = func(doc *surface.Surface) error {
+        calls += 1
+        return fmt.Errorf("disk full")
+    }
+    next := &surface.Surface{Serial: 40, Precedent: 39}
+    if link.saveUpdate(next) == nil || link.saveUpdate(next) == nil || calls != 2 {
+        t.Fatalf("failed save not retried, %d calls", calls)
+    }
+}
+
+// the broker answering a register request with response. returns the upgrade protocol the device asked for
+func fakeRefuse(t *testing.T, conn net.Conn, response string) string {
+    req, err := http.ReadRequest(bufio.NewReader(conn))
+    if err != nil { t.Fatal(err) }
+    _, err = conn.Write([]byte(response))
+    if err != nil { t.Fatal(err) }
+    conn.Close()
+    return req.Header.Get("Upgrade")
+}
+
+func TestLinkMuxFallback(t *testing.T) {
+
+    link, brokers := pipeLink(t)
+    link.Mux        = true
+    link.MinBackoff = time.Millisecond
+    link.MaxBackoff = 2 * time.Millisecond
+    go link.listen()
+
+    // refusing this device for now isn't refusing mux
+    for _, response := range []string{
+        "HTTP/1.1 401 Unauthorized\r\nContent-Length: 0\r\n\r\n",
+        "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n",
+        "HTTP/1.1 429 Too Many Requests\r\nContent-Length: 0\r\n\r\n",
+        "HTTP/1.1 426 Upgrade Required\r\nUpgrade: carrier3-mux, carrier3-cast\r\nContent-Length: 0\r\n\r\n",
+    } {
+        if upgrade := fakeRefuse(t, <- brokers, response); upgrade != UpgradeMux {
+            t.Fatalf("asked for %s before %q", upgrade, response)
+        }
+    }
+    if upgrade := fakeRefuse(t, <- brokers, "HTTP/1.1 426 Upgrade Required\r\nUpgrade: carrier3-cast\r\nContent-Length: 0\r\n\r\n"); upgrade != UpgradeMux {
+        t.Fatalf("asked for %s", upgrade)
+    }
+
+    // the broker doesn't know it, so stop asking
+    for i := 0; i < 2; i++ {
+        if upgrade := fakeRefuse(t, <- brokers, "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n"); upgrade != UpgradeCast {
+            t.Fatalf("still asking for %s after the broker doesn't know it", upgrade)
+        }
+    }
+}
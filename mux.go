@@ -0,0 +1,447 @@
+package carrier3
+
+/*
+carrier3-mux carries many caller streams over one listen connection.
+
+after the 101 to CONNECT /v1/listen with Upgrade: carrier3-mux, both sides exchange frames of
+
+    type    uint8
+    stream  uint32 little endian
+    length  uint16 little endian
+    payload [length]byte
+
+the broker opens streams with odd ids, the device never opens any.
+each side may send muxWindowSize bytes of data on a stream before it has to wait for a muxWindow from the other side,
+so a slow stream never holds up the others.
+*/
+
+import (
+    log "github.com/sirupsen/logrus"
+
+    "encoding/binary"
+    "net"
+    "io"
+    "os"
+    "fmt"
+    "bufio"
+    "errors"
+    "sync"
+    "time"
+)
+
+const (
+    // stream data
+    muxData     uint8 = 0
+    // broker opens a stream. payload is the json api.Connect of the caller
+    muxOpen     uint8 = 1
+    // payload is a uint32 of how many more bytes the sender may send
+    muxWindow   uint8 = 2
+    // sender will not write to the stream anymore
+    muxClose    uint8 = 3
+    // the stream is gone in both directions. payload is an optional reason, like why the caller was rejected
+    muxReset    uint8 = 4
+    // stream 0. payload is echoed back in a muxPong
+    muxPing     uint8 = 5
+    muxPong     uint8 = 6
+)
+
+const muxHeaderSize     = 7
+const muxMaxPayload     = 16 * 1024
+const muxWindowSize     = 256 * 1024
+
+var errMuxClosed = errors.New("mux connection closed")
+
+type muxSession struct {
+    link    *H1Link
+    conn    net.Conn
+
+    wmu     sync.Mutex
+
+    mu      sync.Mutex
+    streams map[uint32]*muxStream
+}
+
+// serves a carrier3-mux listen connection until it breaks, handing every stream the broker opens to Accept
+func (self *H1Link) serveMux(conn net.Conn) error {
+
+    defer self.closeOnDone(conn)()
+
+    session := &muxSession{
+        link:       self,
+        conn:       conn,
+        streams:    make(map[uint32]*muxStream),
+    }
+
+    log.Println("awaiting reverse connections");
+    err := session.run()
+    session.shutdown(err)
+    conn.Close()
+    return err
+}
+
+func (self *muxSession) writeFrame(typ uint8, id uint32, payload []byte) error {
+    var hdr [muxHeaderSize]byte
+    hdr[0] = typ
+    binary.LittleEndian.PutUint32(hdr[1:], id)
+    binary.LittleEndian.PutUint16(hdr[5:], uint16(len(payload)))
+
+    self.wmu.Lock()
+    defer self.wmu.Unlock()
+
+    _, err := self.conn.Write(append(hdr[:], payload...))
+    return err
+}
+
+func (self *muxSession) run() error {
+
+    bio := bufio.NewReader(self.conn)
+    var hdr [muxHeaderSize]byte
+    for ;; {
+        _, err := io.ReadFull(bio, hdr[:])
+        if err != nil { return err }
+
+        typ     := hdr[0]
+        id      := binary.LittleEndian.Uint32(hdr[1:])
+        payload := make([]byte, binary.LittleEndian.Uint16(hdr[5:]))
+
+        _, err = io.ReadFull(bio, payload)
+        if err != nil { return err }
+
+        switch typ {
+            case muxPing:
+                err = self.writeFrame(muxPong, 0, payload)
+                if err != nil { return err }
+                continue
+            case muxPong:
+                continue
+        }
+
+        self.mu.Lock()
+        stream := self.streams[id]
+        self.mu.Unlock()
+
+        switch typ {
+            case muxOpen:
+                if stream != nil || id % 2 == 0 {
+                    return fmt.Errorf("mux: broker opened stream %d twice or with an even id", id)
+                }
+                stream = newMuxStream(self, id)
+
+                self.mu.Lock()
+                self.streams[id] = stream
+                self.mu.Unlock()
+
+                // the Authorizer may take its time, and other streams keep flowing meanwhile.
+                // data for this one is buffered up to the window
+                go func(stream *muxStream, payload []byte) {
+                    h1, err := self.link.stream(stream, payload)
+                    if err != nil {
+                        // rejected callers are already logged
+                        if !errors.Is(err, ErrUnauthorized) {
+                            log.Error(err)
+                        }
+                        stream.reset([]byte(err.Error()))
+                        return
+                    }
+                    self.link.accept(h1)
+                }(stream, payload)
+
+            case muxData:
+                // data can still arrive for a stream we just closed
+                if stream == nil { continue }
+                if !stream.receive(payload) {
+                    stream.reset([]byte("window exceeded"))
+                }
+
+            case muxWindow:
+                if stream == nil { continue }
+                if len(payload) != 4 {
+                    return fmt.Errorf("mux: window update of %d bytes", len(payload))
+                }
+                stream.grow(binary.LittleEndian.Uint32(payload))
+
+            case muxClose:
+                if stream == nil { continue }
+                stream.remoteClose(nil)
+
+            case muxReset:
+                if stream == nil { continue }
+                var err error = io.ErrUnexpectedEOF
+                if len(payload) > 0 {
+                    err = fmt.Errorf("stream reset by broker: %s", payload)
+                }
+                stream.remoteClose(err)
+                self.forget(id)
+
+            default:
+                return fmt.Errorf("mux: unknown frame type %d", typ)
+        }
+    }
+}
+
+func (self *muxSession) forget(id uint32) {
+    self.mu.Lock()
+    delete(self.streams, id)
+    self.mu.Unlock()
+}
+
+// fails all streams after the connection broke
+func (self *muxSession) shutdown(err error) {
+    self.mu.Lock()
+    streams := self.streams
+    self.streams = make(map[uint32]*muxStream)
+    self.mu.Unlock()
+
+    if err == nil {
+        err = errMuxClosed
+    }
+    for _, stream := range streams {
+        stream.remoteClose(fmt.Errorf("%w: %v", errMuxClosed, err))
+    }
+}
+
+// one caller on a mux connection. safe for concurrent use, like a net.Conn
+type muxStream struct {
+    session *muxSession
+    id      uint32
+
+    mu      sync.Mutex
+    cond    *sync.Cond
+
+    // received and not yet read
+    buf     []byte
+    // how many more bytes the broker may send, and how many were read since the last window update
+    recvWindow  uint32
+    consumed    uint32
+    // io.EOF after muxClose from the broker, or why the stream broke
+    rerr    error
+
+    // how many more bytes we may send
+    sendWindow  uint32
+    // set when we closed or the stream broke
+    werr    error
+
+    rdeadline   time.Time
+    wdeadline   time.Time
+    rtimer      *time.Timer
+    wtimer      *time.Timer
+}
+
+func newMuxStream(session *muxSession, id uint32) *muxStream {
+    self := &muxStream{
+        session:    session,
+        id:         id,
+        recvWindow: muxWindowSize,
+        sendWindow: muxWindowSize,
+    }
+    self.cond = sync.NewCond(&self.mu)
+    return self
+}
+
+func (self *muxStream) receive(b []byte) bool {
+    self.mu.Lock()
+    defer self.mu.Unlock()
+
+    if uint32(len(b)) > self.recvWindow {
+        return false
+    }
+    self.recvWindow -= uint32(len(b))
+
+    // we stopped reading, but the broker doesn't know yet
+    if self.rerr != nil {
+        return true
+    }
+
+    self.buf = append(self.buf, b...)
+    self.cond.Broadcast()
+    return true
+}
+
+func (self *muxStream) grow(n uint32) {
+    self.mu.Lock()
+    defer self.mu.Unlock()
+
+    self.sendWindow += n
+    self.cond.Broadcast()
+}
+
+// no more reads. err is nil for a clean muxClose, otherwise writes fail too
+func (self *muxStream) remoteClose(err error) {
+    self.mu.Lock()
+    defer self.mu.Unlock()
+
+    if self.rerr == nil {
+        if err == nil {
+            self.rerr = io.EOF
+        } else {
+            self.rerr = err
+        }
+    }
+    if err != nil && self.werr == nil {
+        self.werr = err
+    }
+    self.cond.Broadcast()
+}
+
+func (self *muxStream) reset(reason []byte) {
+    self.remoteClose(errors.New("stream reset"))
+    self.session.forget(self.id)
+    if len(reason) > muxMaxPayload {
+        reason = reason[:muxMaxPayload]
+    }
+    self.session.writeFrame(muxReset, self.id, reason)
+}
+
+func expired(deadline time.Time) bool {
+    return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+func (self *muxStream) Read(p []byte) (int, error) {
+    self.mu.Lock()
+
+    for len(self.buf) == 0 {
+        if self.rerr != nil {
+            self.mu.Unlock()
+            return 0, self.rerr
+        }
+        if expired(self.rdeadline) {
+            self.mu.Unlock()
+            return 0, os.ErrDeadlineExceeded
+        }
+        self.cond.Wait()
+    }
+
+    n := copy(p, self.buf)
+    self.buf = self.buf[n:]
+
+    // tell the broker it can send more once half the window was read
+    var update uint32
+    self.consumed += uint32(n)
+    if self.consumed >= muxWindowSize / 2 {
+        update = self.consumed
+        self.recvWindow += self.consumed
+        self.consumed = 0
+    }
+    self.mu.Unlock()
+
+    if update > 0 {
+        var b [4]byte
+        binary.LittleEndian.PutUint32(b[:], update)
+        self.session.writeFrame(muxWindow, self.id, b[:])
+    }
+
+    return n, nil
+}
+
+func (self *muxStream) Write(p []byte) (int, error) {
+    var written = 0
+    for written < len(p) {
+        self.mu.Lock()
+        for self.sendWindow == 0 && self.werr == nil && !expired(self.wdeadline) {
+            self.cond.Wait()
+        }
+        if self.werr != nil {
+            self.mu.Unlock()
+            return written, self.werr
+        }
+        if expired(self.wdeadline) {
+            self.mu.Unlock()
+            return written, os.ErrDeadlineExceeded
+        }
+
+        n := len(p) - written
+        if n > muxMaxPayload {
+            n = muxMaxPayload
+        }
+        if uint32(n) > self.sendWindow {
+            n = int(self.sendWindow)
+        }
+        self.sendWindow -= uint32(n)
+        self.mu.Unlock()
+
+        err := self.session.writeFrame(muxData, self.id, p[written:written + n])
+        if err != nil { return written, err }
+        written += n
+    }
+    return written, nil
+}
+
+// Close ends the stream in both directions with a muxReset, since a muxClose would tell the broker we still read.
+// anything the broker still sends is dropped
+func (self *muxStream) Close() error {
+    self.mu.Lock()
+    self.stopTimers()
+    if self.werr != nil {
+        self.mu.Unlock()
+        self.session.forget(self.id)
+        return nil
+    }
+    self.werr = net.ErrClosed
+    if self.rerr == nil {
+        self.rerr = net.ErrClosed
+    }
+    self.buf = nil
+    self.cond.Broadcast()
+    self.mu.Unlock()
+
+    self.session.forget(self.id)
+    return self.session.writeFrame(muxReset, self.id, nil)
+}
+
+func (self *muxStream) stopTimers() {
+    if self.rtimer != nil {
+        self.rtimer.Stop()
+        self.rtimer = nil
+    }
+    if self.wtimer != nil {
+        self.wtimer.Stop()
+        self.wtimer = nil
+    }
+}
+
+func (self *muxStream) SetDeadline(t time.Time) error {
+    self.SetReadDeadline(t)
+    return self.SetWriteDeadline(t)
+}
+
+func (self *muxStream) SetReadDeadline(t time.Time) error {
+    self.mu.Lock()
+    defer self.mu.Unlock()
+
+    self.rdeadline = t
+    self.rtimer = self.wake(self.rtimer, t)
+    return nil
+}
+
+func (self *muxStream) SetWriteDeadline(t time.Time) error {
+    self.mu.Lock()
+    defer self.mu.Unlock()
+
+    self.wdeadline = t
+    self.wtimer = self.wake(self.wtimer, t)
+    return nil
+}
+
+// wakes up waiting reads and writes now and when the deadline t passes
+func (self *muxStream) wake(timer *time.Timer, t time.Time) *time.Timer {
+    if timer != nil {
+        timer.Stop()
+    }
+    self.cond.Broadcast()
+    if t.IsZero() {
+        return nil
+    }
+    return time.AfterFunc(time.Until(t), func() {
+        self.mu.Lock()
+        self.cond.Broadcast()
+        self.mu.Unlock()
+    })
+}
+
+func (self *muxStream) LocalAddr() net.Addr {
+    return self.session.conn.LocalAddr()
+}
+
+func (self *muxStream) RemoteAddr() net.Addr {
+    return self.session.conn.RemoteAddr()
+}
@@ -0,0 +1,356 @@
+package carrier3
+
+import (
+    "github.com/devguardio/carrier3/v3/surface"
+    ik  "github.com/devguardio/identity/go"
+    "testing"
+    "context"
+    "encoding/binary"
+    "encoding/json"
+    "bytes"
+    "errors"
+    "net"
+    "io"
+    "os"
+    "time"
+)
+
+type muxFrame struct {
+    typ     uint8
+    id      uint32
+    payload []byte
+}
+
+// the broker end of a carrier3-mux connection that the link is serving
+type fakeMux struct {
+    t       *testing.T
+    link    *H1Link
+    conn    net.Conn
+    frames  chan muxFrame
+    done    chan error
+}
+
+func newFakeMux(t *testing.T) *fakeMux {
+    link, err := Link(context.Background(), ik.Vault(), &surface.Surface{Serial: 1})
+    if err != nil { t.Fatal(err) }
+    t.Cleanup(func() { link.Close() })
+    // streams are taken from link.accepted directly, without listeners
+    link.start.Do(func() {})
+
+    dev, brk := net.Pipe()
+    self := &fakeMux{
+        t:      t,
+        link:   link,
+        conn:   brk,
+        frames: make(chan muxFrame, 64),
+        done:   make(chan error, 1),
+    }
+    go func() { self.done <- link.serveMux(dev) }()
+
+    go func() {
+        defer close(self.frames)
+        var hdr [muxHeaderSize]byte
+        for ;; {
+            _, err := io.ReadFull(brk, hdr[:])
+            if err != nil { return }
+            f := muxFrame{typ: hdr[0], id: binary.LittleEndian.Uint32(hdr[1:])}
+            f.payload = make([]byte, binary.LittleEndian.Uint16(hdr[5:]))
+            _, err = io.ReadFull(brk, f.payload)
+            if err != nil { return }
+            self.frames <- f
+        }
+    }()
+    t.Cleanup(func() { brk.Close() })
+    return self
+}
+
+func (self *fakeMux) send(typ uint8, id uint32, payload []byte) {
+    var hdr [muxHeaderSize]byte
+    hdr[0] = typ
+    binary.LittleEndian.PutUint32(hdr[1:], id)
+    binary.LittleEndian.PutUint16(hdr[5:], uint16(len(payload)))
+    _, err := self.conn.Write(append(hdr[:], payload...))
+    if err != nil { self.t.Fatal(err) }
+}
+
+func (self *fakeMux) window(id uint32, n uint32) {
+    var b [4]byte
+    binary.LittleEndian.PutUint32(b[:], n)
+    self.send(muxWindow, id, b[:])
+}
+
+func (self *fakeMux) next() muxFrame {
+    select {
+        case f, ok := <- self.frames:
+            if !ok { self.t.Fatal("mux connection closed") }
+            return f
+        case <- time.After(5 * time.Second):
+            self.t.Fatal("no frame from device")
+    }
+    return muxFrame{}
+}
+
+func (self *fakeMux) expect(typ uint8, id uint32) muxFrame {
+    f := self.next()
+    if f.typ != typ || f.id != id {
+        self.t.Fatalf("expected frame %d on stream %d, got %d on %d: %q", typ, id, f.typ, f.id, f.payload)
+    }
+    return f
+}
+
+// nothing but a pong to this ping
+func (self *fakeMux) quiet() {
+    self.send(muxPing, 0, []byte("quiet"))
+    if f := self.expect(muxPong, 0); string(f.payload) != "quiet" {
+        self.t.Fatalf("pong %q", f.payload)
+    }
+}
+
+// reads n bytes of data frames on stream id
+func (self *fakeMux) drain(id uint32, n int) []byte {
+    var b []byte
+    for len(b) < n {
+        f := self.expect(muxData, id)
+        b = append(b, f.payload...)
+    }
+    if len(b) != n {
+        self.t.Fatalf("expected %d bytes, got %d", n, len(b))
+    }
+    return b
+}
+
+func (self *fakeMux) open(id uint32, caller string) net.Conn {
+    js, err := json.Marshal(map[string]string{"Caller": caller})
+    if err != nil { self.t.Fatal(err) }
+    self.send(muxOpen, id, js)
+    select {
+        case c := <- self.link.accepted:
+            return c
+        case <- time.After(5 * time.Second):
+            self.t.Fatal("stream not accepted")
+    }
+    return nil
+}
+
+func caller(t *testing.T) string {
+    me, err := ik.Vault().Identity()
+    if err != nil { t.Fatal(err) }
+    return me.String()
+}
+
+func TestMuxStream(t *testing.T) {
+
+    broker := newFakeMux(t)
+    stream := broker.open(1, caller(t))
+
+    broker.send(muxData, 1, []byte("hello"))
+    var b [16]byte
+    n, err := stream.Read(b[:])
+    if err != nil || string(b[:n]) != "hello" {
+        t.Fatalf("read %q %v", b[:n], err)
+    }
+
+    _, err = stream.Write([]byte("world"))
+    if err != nil { t.Fatal(err) }
+    if f := broker.expect(muxData, 1); string(f.payload) != "world" {
+        t.Fatalf("wrote %q", f.payload)
+    }
+
+    // half closed by the broker, we can still write
+    broker.send(muxClose, 1, nil)
+    _, err = stream.Read(b[:])
+    if err != io.EOF {
+        t.Fatalf("expected EOF after close from broker, got %v", err)
+    }
+    _, err = stream.Write([]byte("still"))
+    if err != nil { t.Fatal(err) }
+    broker.expect(muxData, 1)
+
+    // closing is for both directions
+    err = stream.Close()
+    if err != nil { t.Fatal(err) }
+    if f := broker.expect(muxReset, 1); len(f.payload) != 0 {
+        t.Fatalf("reset with reason %q", f.payload)
+    }
+    _, err = stream.Write([]byte("gone"))
+    if !errors.Is(err, net.ErrClosed) {
+        t.Fatalf("expected closed stream, got %v", err)
+    }
+
+    // late data for it is dropped, and the id can't be confused with a new stream
+    broker.send(muxData, 1, []byte("late"))
+    broker.quiet()
+
+    // the broker going away
+    other := broker.open(3, caller(t))
+    broker.send(muxReset, 3, []byte("caller hung up"))
+    _, err = other.Read(b[:])
+    if err == nil || !bytes.Contains([]byte(err.Error()), []byte("caller hung up")) {
+        t.Fatalf("expected reset with reason, got %v", err)
+    }
+    _, err = other.Write([]byte("x"))
+    if err == nil {
+        t.Fatal("write after reset")
+    }
+    other.Close()
+    broker.quiet()
+}
+
+func TestMuxWindow(t *testing.T) {
+
+    broker := newFakeMux(t)
+    stream := broker.open(1, caller(t))
+
+    // we may send a window worth, then wait for the broker
+    out := make([]byte, muxWindowSize + 1000)
+    for i := range out {
+        out[i] = byte(i)
+    }
+    written := make(chan error, 1)
+    go func() {
+        _, err := stream.Write(out)
+        written <- err
+    }()
+
+    got := broker.drain(1, muxWindowSize)
+    select {
+        case err := <- written:
+            t.Fatalf("write past the window returned %v", err)
+        case <- time.After(50 * time.Millisecond):
+    }
+    broker.window(1, 1000)
+    got = append(got, broker.drain(1, 1000)...)
+    if err := <- written; err != nil { t.Fatal(err) }
+    if !bytes.Equal(got, out) {
+        t.Fatal("data differs")
+    }
+
+    // the broker may send a window worth, and gets more once we read half of it
+    chunk := make([]byte, muxMaxPayload)
+    for sent := 0; sent < muxWindowSize; sent += len(chunk) {
+        broker.send(muxData, 1, chunk)
+    }
+    in := make([]byte, muxWindowSize / 2)
+    _, err := io.ReadFull(stream, in)
+    if err != nil { t.Fatal(err) }
+    f := broker.expect(muxWindow, 1)
+    if binary.LittleEndian.Uint32(f.payload) != muxWindowSize / 2 {
+        t.Fatalf("window update of %d", binary.LittleEndian.Uint32(f.payload))
+    }
+
+    // and no more than that
+    for sent := 0; sent < muxWindowSize / 2; sent += len(chunk) {
+        broker.send(muxData, 1, chunk)
+    }
+    broker.send(muxData, 1, []byte("x"))
+    if f := broker.expect(muxReset, 1); string(f.payload) != "window exceeded" {
+        t.Fatalf("reset with %q", f.payload)
+    }
+    _, err = stream.Write([]byte("x"))
+    if err == nil {
+        t.Fatal("write after reset")
+    }
+}
+
+func TestMuxDeadline(t *testing.T) {
+
+    broker := newFakeMux(t)
+    stream := broker.open(1, caller(t))
+
+    var b [16]byte
+    stream.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+    _, err := stream.Read(b[:])
+    if !errors.Is(err, os.ErrDeadlineExceeded) {
+        t.Fatalf("expected deadline, got %v", err)
+    }
+
+    // a read blocked without a deadline is woken when one is set
+    stream.SetReadDeadline(time.Time{})
+    read := make(chan error, 1)
+    go func() {
+        _, err := stream.Read(b[:])
+        read <- err
+    }()
+    time.Sleep(20 * time.Millisecond)
+    stream.SetReadDeadline(time.Now())
+    if err := <- read; !errors.Is(err, os.ErrDeadlineExceeded) {
+        t.Fatalf("expected deadline, got %v", err)
+    }
+
+    // cleared deadlines don't fire anymore
+    stream.SetReadDeadline(time.Time{})
+    broker.send(muxData, 1, []byte("hi"))
+    n, err := stream.Read(b[:])
+    if err != nil || string(b[:n]) != "hi" {
+        t.Fatalf("read %q %v", b[:n], err)
+    }
+
+    // writes only block on the window
+    _, err = stream.Write(make([]byte, muxWindowSize))
+    if err != nil { t.Fatal(err) }
+    broker.drain(1, muxWindowSize)
+    stream.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+    _, err = stream.Write([]byte("x"))
+    if !errors.Is(err, os.ErrDeadlineExceeded) {
+        t.Fatalf("expected deadline, got %v", err)
+    }
+
+    // close stops the timers
+    stream.SetDeadline(time.Now().Add(time.Hour))
+    stream.Close()
+    ms := stream.(*H1Stream).Conn.(*muxStream)
+    if ms.rtimer != nil || ms.wtimer != nil {
+        t.Fatal("deadline timers still running after close")
+    }
+}
+
+func TestMuxShutdown(t *testing.T) {
+
+    broker := newFakeMux(t)
+    a := broker.open(1, caller(t))
+    b := broker.open(3, caller(t))
+
+    // blocked on the window
+    _, err := b.Write(make([]byte, muxWindowSize))
+    if err != nil { t.Fatal(err) }
+    broker.drain(3, muxWindowSize)
+    written := make(chan error, 1)
+    go func() {
+        _, err := b.Write([]byte("x"))
+        written <- err
+    }()
+
+    broker.conn.Close()
+
+    select {
+        case <- broker.done:
+        case <- time.After(5 * time.Second):
+            t.Fatal("session still running")
+    }
+
+    var buf [1]byte
+    _, err = a.Read(buf[:])
+    if !errors.Is(err, errMuxClosed) {
+        t.Fatalf("expected the mux connection closed, got %v", err)
+    }
+    if err := <- written; !errors.Is(err, errMuxClosed) {
+        t.Fatalf("expected the mux connection closed, got %v", err)
+    }
+}
+
+func TestMuxProtocolError(t *testing.T) {
+
+    broker := newFakeMux(t)
+    broker.open(1, caller(t))
+
+    // stream ids are the broker's to pick, but it can't reuse them
+    js, _ := json.Marshal(map[string]string{"Caller": caller(t)})
+    broker.send(muxOpen, 1, js)
+
+    select {
+        case err := <- broker.done:
+            if err == nil { t.Fatal("session ended without error") }
+        case <- time.After(5 * time.Second):
+            t.Fatal("session survived a duplicate stream id")
+    }
+}
@@ -15,6 +15,7 @@ import (
 func Register(ctx context.Context, vault ik.VaultI, sf *surface.Surface, regkey *ik.Secret) (*api.RegistrationResponse, error) {
 
     dialer := surface.NewDialer(vault, sf);
+    dialer.Clock = surface.DefaultClock
     conn, ingress, err := dialer.DialContext(ctx)
     if err != nil { return nil, err }
     defer conn.Close()
@@ -27,7 +28,7 @@ func Register(ctx context.Context, vault ik.VaultI, sf *surface.Surface, regkey
         },
     }
 
-    cli, err := api.NewClientWithResponses("http://" + ingress.Name, api.WithHTTPClient(doer))
+    cli, err := api.NewClientWithResponses("http://" + ingress.Host(), api.WithHTTPClient(doer))
     if err != nil { return nil, err }
 
     rsp, err := cli.PostV1RegisterWithResponse(ctx, &api.PostV1RegisterParams{
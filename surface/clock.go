@@ -0,0 +1,163 @@
+package surface
+
+import (
+    log "github.com/sirupsen/logrus"
+    "net"
+    "net/http"
+    "context"
+    "bufio"
+    "io"
+    "io/ioutil"
+    "sync"
+    "time"
+    "fmt"
+)
+
+// where an ingress answers time requests. the time is taken from the Date header,
+// so any http server will do.
+const TimePath = "/v1/time"
+
+// Clock is a wall clock for devices without a battery backed RTC.
+//
+// it is anchored to the monotonic clock whenever an authenticated time source is seen,
+// that is a surface document, a verified ingress certificate or the time endpoint of a verified ingress.
+// it never goes backwards, so a replayed older source can't move it into the validity of an expired cert.
+// so that a single bad certificate or Date header can't push it into a future nothing can recover from,
+// ingresses may only move it up to MaxSkew past the newest surface document or the system time, whichever is later.
+type Clock struct {
+    // defaults to DefaultMaxSkew
+    MaxSkew time.Duration
+
+    mu      sync.Mutex
+    anchor  time.Time
+    mono    time.Time
+    // the time of the newest surface document seen
+    signed  time.Time
+}
+
+const DefaultMaxSkew = 30 * 24 * time.Hour
+
+// the clock shared by everything in this process that has no reason to use its own
+var DefaultClock = &Clock{}
+
+// Now returns the trusted time, or the system time if the clock was never anchored
+func (self *Clock) Now() time.Time {
+    self.mu.Lock()
+    defer self.mu.Unlock()
+
+    if self.anchor.IsZero() {
+        return time.Now()
+    }
+    return self.anchor.Add(time.Since(self.mono))
+}
+
+// Synced returns true once the clock has been anchored to an authenticated time
+func (self *Clock) Synced() bool {
+    self.mu.Lock()
+    defer self.mu.Unlock()
+    return !self.anchor.IsZero()
+}
+
+// Advance moves the clock forward to t, the time of a signed surface document. earlier times are ignored
+func (self *Clock) Advance(t time.Time) {
+    if t.IsZero() { return }
+
+    self.mu.Lock()
+    defer self.mu.Unlock()
+
+    if t.After(self.signed) {
+        self.signed = t
+    }
+    self.advance(t)
+}
+
+// moves the clock forward to t, a time an ingress vouched for, unless it's too far in the future to be believed
+func (self *Clock) advanceBounded(t time.Time) error {
+    if t.IsZero() { return nil }
+
+    self.mu.Lock()
+    defer self.mu.Unlock()
+
+    var maxSkew = self.MaxSkew
+    if maxSkew == 0 {
+        maxSkew = DefaultMaxSkew
+    }
+    bound := time.Now()
+    if self.signed.After(bound) {
+        bound = self.signed
+    }
+    bound = bound.Add(maxSkew)
+    if t.After(bound) {
+        return fmt.Errorf("time %v is more than %v ahead, ignored", t, maxSkew)
+    }
+
+    self.advance(t)
+    return nil
+}
+
+func (self *Clock) advance(t time.Time) {
+    now := time.Now()
+    if !self.anchor.IsZero() && !t.After(self.anchor.Add(now.Sub(self.mono))) {
+        return
+    }
+    self.anchor = t.Round(0)
+    self.mono   = now
+}
+
+// Sync requests the current time over an established connection to a verified ingress.
+// The connection stays usable for further requests if no error is returned.
+func (self *Clock) Sync(ctx context.Context, conn net.Conn, host string) error {
+    _, err := self.sync(ctx, conn, host)
+    return err
+}
+
+// sync is Sync that also tells if the connection is still usable after an error
+func (self *Clock) sync(ctx context.Context, conn net.Conn, host string) (bool, error) {
+
+    deadline, ok := ctx.Deadline()
+    if !ok {
+        deadline = time.Now().Add(10 * time.Second)
+    }
+    conn.SetDeadline(deadline)
+    defer conn.SetDeadline(time.Time{})
+
+    req, err := http.NewRequestWithContext(ctx, "GET", "http://" + host + TimePath, nil)
+    if err != nil { return true, err }
+
+    var sent = time.Now()
+
+    err = req.Write(conn)
+    if err != nil { return false, err }
+
+    bio := bufio.NewReader(conn)
+    resp, err := http.ReadResponse(bio, req)
+    if err != nil { return false, err }
+    defer resp.Body.Close()
+
+    _, err = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+    if err != nil { return false, err }
+
+    // the date is authenticated even if the connection can't be used any further
+    t, dateErr := http.ParseTime(resp.Header.Get("Date"))
+    if dateErr == nil {
+        // the server stamped the response somewhere during the round trip
+        t = t.Add(time.Since(sent) / 2)
+
+        dateErr = self.advanceBounded(t)
+        if dateErr == nil {
+            log.WithField("time", t).Debug("clock synced from ingress")
+        }
+    }
+
+    if resp.Close {
+        return false, fmt.Errorf("ingress closed connection after time request")
+    }
+    if bio.Buffered() != 0 {
+        return false, fmt.Errorf("ingress sent unexpected data after time request")
+    }
+    if dateErr != nil {
+        return true, fmt.Errorf("time request: %w", dateErr)
+    }
+
+    return true, nil
+}
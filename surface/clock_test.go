@@ -0,0 +1,156 @@
+package surface
+
+import (
+    "github.com/devguardio/identity/go"
+    "testing"
+    "net"
+    "net/http"
+    "crypto/tls"
+    "bufio"
+    "context"
+    "time"
+)
+
+func TestClock(t *testing.T) {
+
+    var clock Clock
+    if clock.Synced() {
+        t.Fatal("fresh clock claims to be synced")
+    }
+
+    past := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+    clock.Advance(past)
+    if !clock.Synced() {
+        t.Fatal("clock not synced after advance")
+    }
+    if d := clock.Now().Sub(past); d < 0 || d > time.Second {
+        t.Fatalf("clock is off by %v", d)
+    }
+
+    // never goes backwards
+    clock.Advance(past.Add(-time.Hour))
+    if clock.Now().Before(past) {
+        t.Fatal("clock went backwards")
+    }
+
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil { t.Fatal(err) }
+    defer ln.Close()
+    go http.Serve(ln, http.NotFoundHandler())
+
+    conn, err := net.Dial("tcp", ln.Addr().String())
+    if err != nil { t.Fatal(err) }
+    defer conn.Close()
+
+    err = clock.Sync(context.Background(), conn, "ingress.example.com")
+    if err != nil { t.Fatal(err) }
+
+    if d := time.Since(clock.Now()); d > 2 * time.Second || d < -2 * time.Second {
+        t.Fatalf("clock is off by %v after sync", d)
+    }
+}
+
+// an ingress that won't keep the connection after the time request still gets dialed, and still sets the clock
+func TestDialerTimeBestEffort(t *testing.T) {
+
+    const name = "ingress.test"
+
+    secret, err := identity.CreateSecret()
+    if err != nil { t.Fatal(err) }
+    id, err := secret.Identity()
+    if err != nil { t.Fatal(err) }
+
+    ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+        Certificates:   []tls.Certificate{identityChain(t, secret, name)},
+        ClientAuth:     tls.RequireAnyClientCert,
+    })
+    if err != nil { t.Fatal(err) }
+    defer ln.Close()
+
+    var asked = 0
+    mux := http.NewServeMux()
+    mux.HandleFunc(TimePath, func(w http.ResponseWriter, r *http.Request) {
+        asked += 1
+        w.Header().Set("Connection", "close")
+    })
+    go http.Serve(ln, mux)
+
+    var sf = Surface{Serial: 1, Ingresses: []Ingress{{
+        Name:       name,
+        IP:         []net.IP{net.ParseIP("127.0.0.1")},
+        Identity:   id,
+        Port:       uint16(ln.Addr().(*net.TCPAddr).Port),
+    }}}
+
+    var clock Clock
+    dialer := NewDialer(identity.Vault(), &sf)
+    dialer.Resolver = StaticResolver{}
+    dialer.Clock    = &clock
+
+    ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+    defer cancel()
+
+    conn, _, err := dialer.DialContext(ctx)
+    if err != nil { t.Fatal(err) }
+    defer conn.Close()
+
+    if asked != 1 {
+        t.Fatalf("expected one time request, got %d", asked)
+    }
+    if len(dialer.Warnings) != 1 || dialer.Warnings[0].Phase != PhaseTime {
+        t.Fatalf("expected the time sync in Warnings, got %v", dialer.Warnings)
+    }
+    if d := time.Since(clock.Now()); d > 2 * time.Second || d < -2 * time.Second {
+        t.Fatalf("clock is off by %v after sync", d)
+    }
+
+    // the connection we got is usable
+    req, _ := http.NewRequest("GET", "http://" + name + "/", nil)
+    if err = req.Write(conn); err != nil { t.Fatal(err) }
+    resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+    if err != nil { t.Fatal(err) }
+    resp.Body.Close()
+}
+
+// one ingress with a wrong clock can't push ours into the future
+func TestClockMaxSkew(t *testing.T) {
+
+    var date time.Time
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil { t.Fatal(err) }
+    defer ln.Close()
+    go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Date", date.UTC().Format(http.TimeFormat))
+    }))
+
+    conn, err := net.Dial("tcp", ln.Addr().String())
+    if err != nil { t.Fatal(err) }
+    defer conn.Close()
+
+    var clock = Clock{MaxSkew: 24 * time.Hour}
+    clock.Advance(time.Now().Add(-time.Hour))
+
+    date = time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)
+    before := clock.Now()
+    err = clock.Sync(context.Background(), conn, "ingress.example.com")
+    if err == nil {
+        t.Fatal("far future date accepted")
+    }
+    if d := clock.Now().Sub(before); d > 2 * time.Second {
+        t.Fatalf("clock moved by %v", d)
+    }
+
+    // within the skew is fine
+    date = time.Now().Add(time.Hour)
+    err = clock.Sync(context.Background(), conn, "ingress.example.com")
+    if err != nil { t.Fatal(err) }
+    if d := clock.Now().Sub(date); d > 2 * time.Second || d < -2 * time.Second {
+        t.Fatalf("clock is off by %v", d)
+    }
+
+    // a newer surface document extends how far ingresses may move it
+    clock.Advance(time.Now().Add(48 * time.Hour))
+    date = time.Now().Add(60 * time.Hour)
+    err = clock.Sync(context.Background(), conn, "ingress.example.com")
+    if err != nil { t.Fatal(err) }
+}
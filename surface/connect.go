@@ -4,24 +4,73 @@ import (
     "net"
     "crypto/tls"
     "crypto/x509"
+    "crypto/ed25519"
     "context"
     "time"
     "math/rand"
     ik  "github.com/devguardio/identity/go"
     log "github.com/sirupsen/logrus"
-    "fmt"
     "errors"
+    "sync"
+    "fmt"
 )
 
+// the global source is not seeded on older go versions, and reseeding it on every dial is no better
+var shuffleMu   sync.Mutex
+var shuffleRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+
 type Dialer struct {
     Surface *Surface
     Vault   ik.VaultI
+
+    // if set, every http/1.1 connection is used to fetch newer surface documents first.
+    // when one is found, Surface is replaced and dialing restarts with the new ingresses.
+    // that also happens when the walk broke off after some successors were verified,
+    // only an ingress serving a document that doesn't verify is given up on.
+    // an ingress that closes the connection after answering is dialed again without the update
+    Updater *Updater
+
+    // if set, certificates are checked against this clock instead of the surface time,
+    // and it is synced from every ingress we connect to over http/1.1.
+    // a failed sync doesn't fail the connection, it is only recorded in Warnings
+    Clock   *Clock
+
+    // alpn protocols the caller can speak. defaults to http/1.1.
+    // only those also listed by an ingress are offered to it.
+    // if an ingress picks anything but http/1.1, Updater and Clock sync are skipped, see ErrNotHTTP1 in Warnings
+    Protocols []string
+
+    // limits a whole DialContext call, including all ingresses and surface updates. zero means only ctx applies
+    Budget          time.Duration
+
+    // delay between starting parallel connection attempts to the same ingress. defaults to 250ms
+    AttemptDelay    time.Duration
+
+    // timeout of a single connection attempt. defaults to 5 seconds
+    AttemptTimeout  time.Duration
+
+    // remembers which ingresses and addresses worked. share it between dialers to keep it across connections
+    Health          *Health
+
+    // looks up ingress names. defaults to the system resolver
+    Resolver        Resolver
+
+    // timeout of looking up one ingress name. defaults to 1 second
+    ResolveTimeout  time.Duration
+
+    // steps of the last DialContext that went wrong without failing it, like a time sync
+    Warnings        []*DialAttempt
+
+    // trusted for ingresses that pin neither certs nor an identity, like the system pool for a public broker.
+    // if nil, such ingresses can't be verified
+    Roots           *x509.CertPool
 }
 
 func NewDialer(vault ik.VaultI, surface *Surface) *Dialer {
     return &Dialer{
         Surface:    surface,
         Vault:      vault,
+        Health:     NewHealth(),
     }
 }
 
@@ -29,6 +78,18 @@ type Verifier struct {
     Roots       *x509.CertPool
     Time        time.Time
     ServerName  string
+
+    // pinned ed25519 identity. a chain ending in a certificate signed by this identity is trusted instead of Roots
+    Identity    *ik.Identity
+
+    // the address actually dialed. an IP SAN matching it is accepted instead of the name
+    IP          net.IP
+
+    // advanced to the time the certificate was verified against, if verification succeeds
+    Clock       *Clock
+
+    // Time is the untrusted system clock, so expiry is reported as ErrClockSkew
+    SystemTime  bool
 }
 
 func (self *Verifier) VerifyPeerCertificate (certificates [][]byte, _ [][]*x509.Certificate) error {
@@ -50,25 +111,108 @@ func (self *Verifier) VerifyPeerCertificate (certificates [][]byte, _ [][]*x509.
         }
     }
 
+    if len(certs) == 0 {
+        return errors.New("tls: server didn't provide a certificate")
+    }
+
+    // names are checked separately, since x509 ignores the CN
     opts := x509.VerifyOptions{
         Roots:         self.Roots,
         CurrentTime:   self.Time,
-        DNSName:       self.ServerName,
         Intermediates: x509.NewCertPool(),
     }
     for _, cert := range certs[1:] {
         opts.Intermediates.AddCert(cert)
     }
+
+    if root := self.identityRoot(certs); root != nil {
+        opts.Roots = x509.NewCertPool()
+        opts.Roots.AddCert(root)
+    }
+
     var err error
     _ , err = certs[0].Verify(opts)
-    if err != nil { return err }
+    if err == nil {
+        err = self.verifyName(certs[0])
+    }
+    if err != nil {
+        var invalid x509.CertificateInvalidError
+        if errors.As(err, &invalid) && invalid.Reason == x509.Expired {
+            if self.SystemTime {
+                return &classifiedError{err: err, class: ErrClockSkew}
+            }
+            return &classifiedError{err: err, class: ErrCertificateExpired}
+        }
+        return err
+    }
+
+    if self.Clock != nil {
+        err = self.Clock.advanceBounded(self.Time)
+        if err != nil {
+            log.Warn("clock not advanced to ingress certificate: ", err)
+        }
+    }
 
     return nil
 }
 
 
 
-func selfcert(vault ik.VaultI) (tls.Certificate, error) {
+// the last certificate of the chain, if it is the pinned identity signing itself
+func (self *Verifier) identityRoot(certs []*x509.Certificate) *x509.Certificate {
+    if self.Identity == nil {
+        return nil
+    }
+
+    top := certs[len(certs)-1]
+
+    pkey, ok := top.PublicKey.(ed25519.PublicKey)
+    if !ok || len(pkey) != len(self.Identity) {
+        return nil
+    }
+    var id ik.Identity
+    copy(id[:], pkey[:])
+    if !id.Equal(self.Identity) {
+        return nil
+    }
+
+    cacert, err := self.Identity.ToCertificate()
+    if err != nil { return nil }
+
+    if top.CheckSignatureFrom(cacert) != nil {
+        return nil
+    }
+
+    return top
+}
+
+// either a DNS SAN or the CN must match the server name, or an IP SAN must match the dialed address.
+// the latter is for ingresses that are only reachable by their fixed address records
+func (self *Verifier) verifyName(leaf *x509.Certificate) error {
+    if self.ServerName != "" {
+        if leaf.VerifyHostname(self.ServerName) == nil {
+            return nil
+        }
+        if leaf.Subject.CommonName == self.ServerName {
+            return nil
+        }
+    }
+    if self.IP != nil {
+        for _, ip := range leaf.IPAddresses {
+            if ip.Equal(self.IP) {
+                return nil
+            }
+        }
+    }
+    var host = self.ServerName
+    if host == "" && self.IP != nil {
+        host = self.IP.String()
+    }
+    return x509.HostnameError{Certificate: leaf, Host: host}
+}
+
+// SelfCert is the tls certificate of a vault identity: a fresh key, signed by the vault, with the vault's own certificate as root
+func SelfCert(vault ik.VaultI) (tls.Certificate, error) {
 
     crt := tls.Certificate{}
 
@@ -105,92 +249,308 @@ func selfcert(vault ik.VaultI) (tls.Certificate, error) {
 
 func (self *Dialer) DialContext(ctx context.Context) (*tls.Conn, *Ingress, error) {
 
-    rand.Seed(time.Now().Unix())
-
+    if self.Health == nil {
+        self.Health = NewHealth()
+    }
 
-    selfcert, err := selfcert(self.Vault);
+    selfcert, err := SelfCert(self.Vault);
     if err != nil { return nil, nil, err }
 
+    if self.Budget > 0 {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, self.Budget)
+        defer cancel()
+    }
+
+    self.Warnings = nil
+    for ;; {
+        conn, ingress, updated, err := self.dialSurface(ctx, selfcert)
+        if err != nil { return nil, nil, err }
+        if !updated {
+            return conn, ingress, nil
+        }
+        log.WithField("serial", self.Surface.Serial).Info("surface updated, restarting dial");
+    }
+}
+
+func (self *Dialer) dialSurface(ctx context.Context, selfcert tls.Certificate) (*tls.Conn, *Ingress, bool, error) {
 
-    for index, ingress := range self.Surface.Ingresses {
-        if ingress.Name == "" { continue }
+    var protocols = self.Protocols
+    if len(protocols) == 0 {
+        protocols = []string{"http/1.1"}
+    }
+
+    var attemptDelay = self.AttemptDelay
+    if attemptDelay == 0 {
+        attemptDelay = 250 * time.Millisecond
+    }
+    var attemptTimeout = self.AttemptTimeout
+    if attemptTimeout == 0 {
+        attemptTimeout = 5 * time.Second
+    }
+    var resolver = self.Resolver
+    if resolver == nil {
+        resolver = net.DefaultResolver
+    }
+    var resolveTimeout = self.ResolveTimeout
+    if resolveTimeout == 0 {
+        resolveTimeout = time.Second
+    }
+
+    var names []string
+    for _, ingress := range self.Surface.Ingresses {
+        names = append(names, ingress.Host())
+    }
+
+    var failed      = &DialError{}
+    var failedMu    sync.Mutex
+    // a failed attempt is only a problem if all of them fail, which DialError reports
+    fail := func(a *DialAttempt) {
+        log.WithField("ingress", a.Index).WithField("address", a.IP).WithField("phase", a.Phase).Debug(a.Err);
+        failedMu.Lock()
+        failed.Attempts = append(failed.Attempts, a)
+        failedMu.Unlock()
+    }
+    warn := func(a *DialAttempt) {
+        log.WithField("ingress", a.Index).WithField("address", a.IP).WithField("phase", a.Phase).Warn(a.Err);
+        self.Warnings = append(self.Warnings, a)
+    }
+
+    for _, index := range self.Health.OrderIngresses(names) {
+        ingress := self.Surface.Ingresses[index]
+        // an ingress without a name is dialed by its ips, and verified against the one dialed
+        if ingress.Host() == "" { continue }
+
+        var nextProtos []string
+        for _, p := range ingress.Protocols {
+            for _, p2 := range protocols {
+                if p == p2 {
+                    nextProtos = append(nextProtos, p)
+                }
+            }
+        }
+        if len(ingress.Protocols) > 0 && len(nextProtos) == 0 {
+            fail(&DialAttempt{Index: index, Name: ingress.Name, Phase: PhaseALPN,
+                Err: fmt.Errorf("%w: %v", ErrNoProtocol, ingress.Protocols)})
+            continue
+        }
+
+        var port = int(ingress.Port)
+        if port == 0 {
+            port = 443
+        }
 
         // fixed ips
-        allIps := ingress.IP
+        allIps := append([]net.IP{}, ingress.IP...)
 
         // lookup more ips by DNS
-        ctx2, cancel := context.WithTimeout(ctx, time.Second)
-        defer cancel()
-        var resolver net.Resolver
-        more, _ := resolver.LookupIP(ctx2, "ip", ingress.Name)
-        allIps = append(allIps, more...)
+        var err error
+        if ingress.Name != "" {
+            var more []net.IP
+            ctx2, cancel := context.WithTimeout(ctx, resolveTimeout)
+            more, err = resolver.LookupIP(ctx2, "ip", ingress.Name)
+            cancel()
+            if err != nil {
+                fail(&DialAttempt{Index: index, Name: ingress.Name, Phase: PhaseDNS, Err: err})
+            }
+            allIps = append(allIps, more...)
+        }
 
         // if we have none, try the next surface
-        if len(allIps) == 0 {continue}
+        if len(allIps) == 0 {
+            if err == nil {
+                fail(&DialAttempt{Index: index, Name: ingress.Name, Phase: PhaseDNS, Err: ErrNoAddresses})
+            }
+            continue
+        }
 
-        // randomize ips
-        rand.Shuffle(len(allIps), func(i, j int) { allIps[i], allIps[j] = allIps[j], allIps[i] })
+        // randomize ips, but alternate address families, and start with what worked before
+        shuffleMu.Lock()
+        shuffleRand.Shuffle(len(allIps), func(i, j int) { allIps[i], allIps[j] = allIps[j], allIps[i] })
+        shuffleMu.Unlock()
+        allIps = self.Health.OrderAddresses(interleave(allIps))
 
         //prepare trust
         var timestamp = self.Surface.Time
-        if timestamp.IsZero() {
+        var systemTime = false
+        if self.Clock != nil {
+            self.Clock.Advance(timestamp)
+            timestamp = self.Clock.Now()
+            systemTime = !self.Clock.Synced()
+        } else if timestamp.IsZero() {
             timestamp = time.Now()
+            systemTime = true
             log.WithField("ingress", index).Warn("surface timestamp is zero. falling back to system clock");
         }
 
+        // the pinned identity is checked by the verifier, since we can't make a root for it
         root := x509.NewCertPool()
         for _, cert := range ingress.Certs {
             root.AddCert(cert)
         }
-
-        if ingress.Identity != nil {
-            tpl, err := ingress.Identity.ToCertificate(ik.CertOpts{DNSNames:[]string{ingress.Name}})
-            tpl.NotBefore   = timestamp.Add(-time.Hour)
-            tpl.NotAfter    = timestamp.Add(time.Hour)
-            if err != nil {
-                der, err := self.Vault.SignCertificate(tpl, ingress.Identity)
-                cert, err := x509.ParseCertificate(der)
-                if err == nil {
-                    root.AddCert(cert)
-                }
-            }
+        if len(ingress.Certs) == 0 && ingress.Identity == nil && self.Roots != nil {
+            root = self.Roots
         }
 
-        var verifier = Verifier {
-            Roots:          root,
-            Time:           timestamp,
-            ServerName:     ingress.Name,
-        }
+        attempt := func(ctx context.Context, ip net.IP) (*tls.Conn, error) {
+
+            // attempts run in parallel, and the verifier keeps state
+            var verifier = Verifier {
+                Roots:          root,
+                Time:           timestamp,
+                ServerName:     ingress.Name,
+                Identity:       ingress.Identity,
+                IP:             ip,
+                Clock:          self.Clock,
+                SystemTime:     systemTime,
+            }
 
-        var tlsdialer = tls.Dialer {
-            Config: &tls.Config {
+            var verifyErr error
+            var config = &tls.Config {
                 RootCAs:    root,
                 Time:       func() time.Time { return timestamp },
-                //NextProtos: []string{"h2", "http/1.1"},
+                NextProtos: nextProtos,
                 ServerName: ingress.Name,
                 InsecureSkipVerify: true,
-                VerifyPeerCertificate: verifier.VerifyPeerCertificate,
+                VerifyPeerCertificate: func(certificates [][]byte, chains [][]*x509.Certificate) error {
+                    verifyErr = verifier.VerifyPeerCertificate(certificates, chains)
+                    return verifyErr
+                },
                 Certificates: []tls.Certificate{selfcert},
-            },
-        }
-
-        log.Println(allIps);
+            }
 
-        // now try every ip
-        for _, ip := range allIps {
-            ctx2, cancel := context.WithTimeout(ctx, 5 * time.Second)
+            ctx2, cancel := context.WithTimeout(ctx, attemptTimeout)
             defer cancel()
-            conn, err := tlsdialer.DialContext(ctx2, "tcp", (&net.TCPAddr{
+
+            var started = time.Now()
+
+            var phase = PhaseTCP
+            var netdialer net.Dialer
+            raw, err := netdialer.DialContext(ctx2, "tcp", (&net.TCPAddr{
                 IP: ip,
-                Port: 443,
+                Port: port,
             }).String())
+
+            var conn *tls.Conn
             if err == nil {
-                return conn.(*tls.Conn), &ingress, nil
-            } else {
-                log.WithField("ingress", index).WithField("address", ip).Warn(err);
+                phase = PhaseTLS
+                conn = tls.Client(raw, config)
+                err = conn.HandshakeContext(ctx2)
+                if err != nil {
+                    raw.Close()
+                }
+                if verifyErr != nil {
+                    phase   = PhaseVerify
+                    err     = verifyErr
+                }
             }
+
+            if err != nil {
+                // losing a race is not the address's fault
+                if ctx.Err() == nil {
+                    fail(&DialAttempt{Index: index, Name: ingress.Name, IP: ip, Phase: phase, Err: err})
+                    self.Health.AddressFailure(ip)
+                }
+                return nil, err
+            }
+            self.Health.AddressSuccess(ip, time.Since(started))
+            return conn, nil
         }
+
+        log.WithField("ingress", index).WithField("addresses", allIps).Debug("dialing");
+
+        var started = time.Now()
+        var skipSync = false
+        var skipUpdate = false
+
+        // race all ips, and if the winner turns out to be unusable, race the remaining ones
+        for len(allIps) > 0 {
+            conn, ip, err := race(ctx, allIps, attemptDelay, attempt)
+            if err != nil {
+                break
+            }
+            for i := range allIps {
+                if allIps[i].Equal(ip) {
+                    allIps = append(allIps[:i:i], allIps[i+1:]...)
+                    break
+                }
+            }
+
+            // the surface protocol is spoken in http1, so it's up to the caller to do it over anything else
+            if proto := conn.ConnectionState().NegotiatedProtocol; proto != "" && proto != "http/1.1" {
+                if self.Updater != nil {
+                    warn(&DialAttempt{Index: index, Name: ingress.Name, IP: ip, Phase: PhaseUpdate, Err: fmt.Errorf("%w: %s", ErrNotHTTP1, proto)})
+                }
+                if self.Clock != nil {
+                    warn(&DialAttempt{Index: index, Name: ingress.Name, IP: ip, Phase: PhaseTime, Err: fmt.Errorf("%w: %s", ErrNotHTTP1, proto)})
+                }
+                self.Health.IngressSuccess(ingress.Host(), time.Since(started))
+                return conn, &ingress, false, nil
+            }
+
+            if self.Updater != nil && !skipUpdate {
+                next, err := self.Updater.Update(ctx, conn, ingress.Host(), self.Surface)
+
+                // already up to date, but the ingress hung up. try the same address again without updating
+                if errors.Is(err, ErrUpdateClosed) && next == nil {
+                    conn.Close()
+                    skipUpdate = true
+                    allIps = append([]net.IP{ip}, allIps...)
+                    continue
+                }
+
+                // an ingress serving a bad document can't be trusted with anything else either
+                var bad *UpdateError
+                if errors.As(err, &bad) && next == nil {
+                    fail(&DialAttempt{Index: index, Name: ingress.Name, IP: ip, Phase: PhaseUpdate, Err: err})
+                    conn.Close()
+                    break
+                }
+
+                // keep what was verified before the walk broke off, and continue from there on a new connection
+                if next != nil {
+                    if err != nil && !errors.Is(err, ErrUpdateClosed) {
+                        log.WithField("ingress", index).WithField("serial", next.Serial).Warn("surface update stopped early: ", err)
+                    }
+                    conn.Close()
+                    self.Surface = next
+                    return nil, nil, true, nil
+                }
+
+                if err != nil {
+                    fail(&DialAttempt{Index: index, Name: ingress.Name, IP: ip, Phase: PhaseUpdate, Err: err})
+                    conn.Close()
+                    break
+                }
+            }
+
+            // best effort. the clock already advanced from the certificate and the document time
+            if self.Clock != nil && !skipSync {
+                usable, err := self.Clock.sync(ctx, conn, ingress.Host())
+                if err != nil {
+                    warn(&DialAttempt{Index: index, Name: ingress.Name, IP: ip, Phase: PhaseTime, Err: err})
+                }
+                if !usable {
+                    // try the same address again without asking for the time
+                    conn.Close()
+                    skipSync = true
+                    allIps = append([]net.IP{ip}, allIps...)
+                    continue
+                }
+            }
+
+            self.Health.IngressSuccess(ingress.Host(), time.Since(started))
+            return conn, &ingress, false, nil
+        }
+
+        if ctx.Err() != nil {
+            break
+        }
+        self.Health.IngressFailure(ingress.Host())
     }
-    return nil, nil, fmt.Errorf("out of options");
-}
 
+    failedMu.Lock()
+    defer failedMu.Unlock()
+    failed.Err = ctx.Err()
+    return nil, nil, false, failed
+}
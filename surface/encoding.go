@@ -0,0 +1,103 @@
+package surface
+
+import (
+    "github.com/devguardio/identity/go"
+    "encoding/pem"
+    "bytes"
+    "fmt"
+    "strings"
+)
+
+// text encodings of a document, for places that don't take binary,
+// like provisioning forms, env vars and kernel command lines
+type Format int
+
+const (
+    FormatRaw       Format = iota
+    // -----BEGIN SURFACE-----
+    FormatPEM
+    // identity.Message with Key "S", a single word starting with 'c'
+    FormatMessage
+)
+
+const PEMType    = "SURFACE"
+const MessageKey = "S"
+
+var Formats = []Format{FormatRaw, FormatPEM, FormatMessage}
+
+func (self Format) String() string {
+    switch self {
+        case FormatRaw:     return "raw"
+        case FormatPEM:     return "pem"
+        case FormatMessage: return "message"
+    }
+    return fmt.Sprintf("Format(%d)", int(self))
+}
+
+func FormatFromString(s string) (Format, error) {
+    for _, f := range Formats {
+        if f.String() == s {
+            return f, nil
+        }
+    }
+    return FormatRaw, fmt.Errorf("unknown surface format '%s', expected raw, pem or message", s)
+}
+
+// Unarmor returns the binary document in b, which can be in any Format
+func Unarmor(b []byte) ([]byte, Format, error) {
+
+    // raw documents start with the magic, which is never whitespace, '-' or 'c'
+    if len(b) > 0 && b[0] == 'S' {
+        return b, FormatRaw, nil
+    }
+
+    t := bytes.TrimSpace(b)
+
+    if bytes.HasPrefix(t, []byte("-----BEGIN ")) {
+        block, _ := pem.Decode(t)
+        if block == nil {
+            return nil, FormatPEM, fmt.Errorf("doesn't look like a surface document: broken pem")
+        }
+        if block.Type != PEMType {
+            return nil, FormatPEM, fmt.Errorf("doesn't look like a surface document: pem type is %s", block.Type)
+        }
+        return block.Bytes, FormatPEM, nil
+    }
+
+    if len(t) > 0 && t[0] == 'c' {
+        msg, err := identity.MessageFromString(strings.TrimSpace(string(t)))
+        if err != nil {
+            return nil, FormatMessage, fmt.Errorf("doesn't look like a surface document: %w", err)
+        }
+        if msg.Key != MessageKey {
+            return nil, FormatMessage, fmt.Errorf("doesn't look like a surface document: message key is '%s'", msg.Key)
+        }
+        return msg.Value, FormatMessage, nil
+    }
+
+    return b, FormatRaw, nil
+}
+
+// Decode is Parse for a document in any Format
+func Decode(b []byte) (*Surface, error) {
+    rr, _, err := Unarmor(b)
+    if err != nil { return nil, err }
+    return Parse(rr)
+}
+
+// Encode serializes the document in the given Format.
+// text formats end with a newline.
+func (doc *Surface) Encode(format Format) ([]byte, error) {
+    b, err := doc.Serialize()
+    if err != nil { return nil, err }
+
+    switch format {
+        case FormatRaw:
+            return b, nil
+        case FormatPEM:
+            return pem.EncodeToMemory(&pem.Block{Type: PEMType, Bytes: b}), nil
+        case FormatMessage:
+            return []byte((&identity.Message{Key: MessageKey, Value: b}).String() + "\n"), nil
+    }
+    return nil, fmt.Errorf("unknown surface format %v", format)
+}
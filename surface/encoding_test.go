@@ -0,0 +1,55 @@
+package surface
+
+import (
+    "testing"
+    "bytes"
+    "time"
+)
+
+func TestEncoding(t *testing.T) {
+
+    var doc = Surface{Serial: 7, Precedent: 6, Time: time.Now()}
+    doc.Ingress(0).Name = "s7.ingress.devguard.io"
+
+    raw := serialize(t, &doc)
+
+    for _, f := range Formats {
+        b, err := doc.Encode(f)
+        if err != nil { t.Fatal(err) }
+
+        // pasted text picks up surrounding whitespace
+        if f != FormatRaw {
+            b = append(append([]byte("  \n"), b...), "\r\n"...)
+        }
+
+        rr, got, err := Unarmor(b)
+        if err != nil { t.Fatalf("%v: %v", f, err) }
+        if got != f {
+            t.Fatalf("%v detected as %v", f, got)
+        }
+        if !bytes.Equal(rr, raw) {
+            t.Fatalf("%v: decoded to different bytes", f)
+        }
+
+        out, err := Decode(b)
+        if err != nil { t.Fatalf("%v: %v", f, err) }
+        if out.Serial != 7 || out.Ingresses[0].Name != doc.Ingresses[0].Name {
+            t.Fatalf("%v: decoded wrong document", f)
+        }
+
+        ff, err := FormatFromString(f.String())
+        if err != nil || ff != f {
+            t.Fatalf("%v does not round trip through its name", f)
+        }
+    }
+
+    _, err := Decode([]byte("-----BEGIN CERTIFICATE-----\nAAAA\n-----END CERTIFICATE-----\n"))
+    if err == nil {
+        t.Fatal("accepted a certificate as surface")
+    }
+
+    _, err = Decode([]byte("cDYAVGUZRAIAYL6GR2YDNDFZ3SIW6CMA44VVIQ7WIZS5KCBHHKOEWTQGH2NAXAU77"))
+    if err == nil {
+        t.Fatal("accepted a broken message")
+    }
+}
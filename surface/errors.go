@@ -0,0 +1,150 @@
+package surface
+
+import (
+    "net"
+    "errors"
+    "fmt"
+    "strings"
+)
+
+var (
+    ErrNoAddresses          = errors.New("no addresses")
+    ErrCertificateExpired   = errors.New("ingress certificate expired")
+
+    // the certificate looks expired, but we only had the untrusted system clock to check it against
+    ErrClockSkew            = errors.New("ingress certificate expired according to system clock, which may be wrong")
+
+    // the ingress lists protocols, but none of Dialer.Protocols
+    ErrNoProtocol           = errors.New("ingress speaks none of our protocols")
+
+    // surface updates and time sync are spoken in http1, so they are skipped on anything else
+    ErrNotHTTP1             = errors.New("negotiated protocol is not http/1.1, skipped")
+
+    // the surface update went fine, but the ingress closed the connection after it
+    ErrUpdateClosed         = errors.New("ingress closed the connection after a surface update")
+)
+
+// DialPhase is the step of connecting to an ingress that failed
+type DialPhase int
+
+const (
+    PhaseDNS DialPhase = iota + 1
+    PhaseTCP
+    PhaseTLS
+    PhaseVerify
+    PhaseUpdate
+    PhaseTime
+    PhaseALPN
+)
+
+func (self DialPhase) String() string {
+    switch self {
+        case PhaseDNS:      return "dns"
+        case PhaseTCP:      return "tcp"
+        case PhaseTLS:      return "tls"
+        case PhaseVerify:   return "verify"
+        case PhaseUpdate:   return "update"
+        case PhaseTime:     return "time"
+        case PhaseALPN:     return "alpn"
+    }
+    return fmt.Sprintf("phase%d", int(self))
+}
+
+// DialAttempt is one failed step of dialing a surface
+type DialAttempt struct {
+    Index   int
+    Name    string
+    IP      net.IP
+    Phase   DialPhase
+    Err     error
+}
+
+func (self *DialAttempt) Error() string {
+    if self.IP == nil {
+        return fmt.Sprintf("ingress %d (%s) %s: %v", self.Index, self.Name, self.Phase, self.Err)
+    }
+    return fmt.Sprintf("ingress %d (%s) %s %s: %v", self.Index, self.Name, self.IP, self.Phase, self.Err)
+}
+
+func (self *DialAttempt) Unwrap() error {
+    return self.Err
+}
+
+// DialError is returned by Dialer.DialContext when no ingress could be used.
+//
+// errors.Is and errors.As match against every attempt, so for example
+// errors.Is(err, ErrCertificateExpired) tells if any ingress presented an expired certificate.
+type DialError struct {
+    Attempts    []*DialAttempt
+
+    // set if dialing was aborted by the context
+    Err         error
+}
+
+func (self *DialError) Error() string {
+    var reason = "out of options"
+    if self.Err != nil {
+        reason = self.Err.Error()
+    }
+    if len(self.Attempts) == 0 {
+        return reason + ": no usable ingress"
+    }
+    var s []string
+    for _, a := range self.Attempts {
+        s = append(s, a.Error())
+    }
+    return reason + ": " + strings.Join(s, "; ")
+}
+
+func (self *DialError) Is(target error) bool {
+    if self.Err != nil && errors.Is(self.Err, target) {
+        return true
+    }
+    for _, a := range self.Attempts {
+        if errors.Is(a, target) {
+            return true
+        }
+    }
+    return false
+}
+
+func (self *DialError) As(target interface{}) bool {
+    if self.Err != nil && errors.As(self.Err, target) {
+        return true
+    }
+    for _, a := range self.Attempts {
+        if errors.As(a, target) {
+            return true
+        }
+    }
+    return false
+}
+
+// Phase returns the attempts that failed in the given phase
+func (self *DialError) Phase(phase DialPhase) []*DialAttempt {
+    var r []*DialAttempt
+    for _, a := range self.Attempts {
+        if a.Phase == phase {
+            r = append(r, a)
+        }
+    }
+    return r
+}
+
+// keeps the x509 error for errors.As, but also matches a sentinel for errors.Is
+type classifiedError struct {
+    err     error
+    class   error
+}
+
+func (self *classifiedError) Error() string {
+    return self.class.Error() + ": " + self.err.Error()
+}
+
+func (self *classifiedError) Unwrap() error {
+    return self.err
+}
+
+func (self *classifiedError) Is(target error) bool {
+    return target == self.class
+}
@@ -0,0 +1,81 @@
+package surface
+
+import (
+    "github.com/devguardio/identity/go"
+    "testing"
+    "net"
+    "crypto/x509"
+    "context"
+    "errors"
+    "time"
+)
+
+func TestDialError(t *testing.T) {
+
+    expired := x509.CertificateInvalidError{Reason: x509.Expired}
+
+    var err error = &DialError{
+        Attempts: []*DialAttempt{
+            {Index: 0, Name: "s1.ingress.devguard.io", Phase: PhaseDNS, Err: ErrNoAddresses},
+            {Index: 1, Name: "fallback.devguard.io", IP: net.ParseIP("192.0.2.1"), Phase: PhaseVerify,
+                Err: &classifiedError{err: expired, class: ErrCertificateExpired}},
+        },
+    }
+
+    if !errors.Is(err, ErrCertificateExpired) {
+        t.Fatal("expiry not found")
+    }
+    if errors.Is(err, ErrClockSkew) {
+        t.Fatal("expiry reported as clock skew")
+    }
+
+    var invalid x509.CertificateInvalidError
+    if !errors.As(err, &invalid) || invalid.Reason != x509.Expired {
+        t.Fatal("x509 error not found")
+    }
+
+    var attempt *DialAttempt
+    if !errors.As(err, &attempt) || attempt.Phase != PhaseDNS {
+        t.Fatal("attempt not found")
+    }
+
+    if len(err.(*DialError).Phase(PhaseVerify)) != 1 {
+        t.Fatal("verify attempt not found")
+    }
+}
+
+func TestDialErrorRefused(t *testing.T) {
+
+    // a port nothing listens on
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil { t.Fatal(err) }
+    port := ln.Addr().(*net.TCPAddr).Port
+    ln.Close()
+
+    var sf = Surface{Serial: 1, Time: time.Now(), Ingresses: []Ingress{{
+        Name:   "ingress.invalid",
+        IP:     []net.IP{net.ParseIP("127.0.0.1")},
+        Port:   uint16(port),
+    }}}
+
+    dialer := NewDialer(identity.Vault(), &sf)
+    dialer.Resolver = StaticResolver{}
+
+    _, _, err = dialer.DialContext(context.Background())
+
+    var dialErr *DialError
+    if !errors.As(err, &dialErr) {
+        t.Fatalf("expected dial error, got %v", err)
+    }
+    if len(dialErr.Phase(PhaseDNS)) != 1 {
+        t.Fatalf("expected one dns attempt: %v", err)
+    }
+    tcp := dialErr.Phase(PhaseTCP)
+    if len(tcp) != 1 || !tcp[0].IP.Equal(net.ParseIP("127.0.0.1")) {
+        t.Fatalf("expected one tcp attempt: %v", err)
+    }
+    var opErr *net.OpError
+    if !errors.As(err, &opErr) {
+        t.Fatalf("expected net.OpError: %v", err)
+    }
+}
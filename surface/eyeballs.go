@@ -0,0 +1,116 @@
+package surface
+
+import (
+    "net"
+    "crypto/tls"
+    "context"
+    "time"
+    "fmt"
+)
+
+// staggered parallel connection attempts to the ips of one ingress, as in RFC 8305.
+//
+// a new attempt is started every delay, or immediately when one fails.
+// the first attempt to complete wins, all others are canceled and their connections closed.
+func race(ctx context.Context, ips []net.IP, delay time.Duration, attempt func(context.Context, net.IP) (*tls.Conn, error)) (*tls.Conn, net.IP, error) {
+
+    if len(ips) == 0 {
+        return nil, nil, fmt.Errorf("no addresses")
+    }
+
+    ctx, cancel := context.WithCancel(ctx)
+    defer cancel()
+
+    type result struct {
+        conn    *tls.Conn
+        ip      net.IP
+        err     error
+    }
+    results := make(chan result, len(ips))
+
+    var started = 0
+    var pending = 0
+    var lastErr error
+
+    start := func() {
+        ip := ips[started]
+        started += 1
+        pending += 1
+        go func() {
+            conn, err := attempt(ctx, ip)
+            results <- result{conn, ip, err}
+        }()
+    }
+
+    timer := time.NewTimer(0)
+    defer timer.Stop()
+
+    for ;; {
+        select {
+            case <- timer.C:
+                if started < len(ips) {
+                    start()
+                    timer.Reset(delay)
+                }
+            case r := <- results:
+                pending -= 1
+                if r.err == nil {
+                    // losers are canceled when we return, close whatever they still manage to establish
+                    go func(pending int) {
+                        for i := 0; i < pending; i++ {
+                            if r := <- results; r.conn != nil {
+                                r.conn.Close()
+                            }
+                        }
+                    }(pending)
+                    return r.conn, r.ip, nil
+                }
+                lastErr = r.err
+                if started < len(ips) {
+                    if !timer.Stop() {
+                        select {
+                            case <- timer.C:
+                            default:
+                        }
+                    }
+                    start()
+                    timer.Reset(delay)
+                } else if pending == 0 {
+                    return nil, nil, lastErr
+                }
+            case <- ctx.Done():
+                go func(pending int) {
+                    for i := 0; i < pending; i++ {
+                        if r := <- results; r.conn != nil {
+                            r.conn.Close()
+                        }
+                    }
+                }(pending)
+                return nil, nil, ctx.Err()
+        }
+    }
+}
+
+// interleave address families, starting with v6, as in RFC 8305 section 4.
+// the order within each family is kept
+func interleave(ips []net.IP) []net.IP {
+    var v4, v6 []net.IP
+    for _, ip := range ips {
+        if ip.To4() != nil {
+            v4 = append(v4, ip)
+        } else {
+            v6 = append(v6, ip)
+        }
+    }
+
+    var r = make([]net.IP, 0, len(ips))
+    for i := 0; i < len(v4) || i < len(v6); i++ {
+        if i < len(v6) {
+            r = append(r, v6[i])
+        }
+        if i < len(v4) {
+            r = append(r, v4[i])
+        }
+    }
+    return r
+}
@@ -0,0 +1,71 @@
+package surface
+
+import (
+    "testing"
+    "net"
+    "crypto/tls"
+    "context"
+    "errors"
+    "time"
+)
+
+func TestRace(t *testing.T) {
+
+    slow := net.ParseIP("192.0.2.1")
+    fast := net.ParseIP("2001:db8::1")
+
+    canceled := make(chan bool, 1)
+
+    attempt := func(ctx context.Context, ip net.IP) (*tls.Conn, error) {
+        if ip.Equal(slow) {
+            <- ctx.Done()
+            canceled <- true
+            return nil, ctx.Err()
+        }
+        time.Sleep(10 * time.Millisecond)
+        c1, c2 := net.Pipe()
+        c2.Close()
+        return tls.Client(c1, &tls.Config{}), nil
+    }
+
+    started := time.Now()
+    conn, ip, err := race(context.Background(), []net.IP{slow, fast}, 50 * time.Millisecond, attempt)
+    if err != nil { t.Fatal(err) }
+    defer conn.Close()
+
+    if !ip.Equal(fast) {
+        t.Fatalf("wrong winner %s", ip)
+    }
+    if time.Since(started) > time.Second {
+        t.Fatalf("waited for the slow attempt")
+    }
+
+    select {
+        case <- canceled:
+        case <- time.After(time.Second):
+            t.Fatalf("losing attempt was not canceled")
+    }
+
+    failed := errors.New("unreachable")
+    _, _, err = race(context.Background(), []net.IP{slow, fast}, time.Hour, func(ctx context.Context, ip net.IP) (*tls.Conn, error) {
+        return nil, failed
+    })
+    if err != failed {
+        t.Fatalf("expected attempt error, got %v", err)
+    }
+}
+
+func TestInterleave(t *testing.T) {
+    ips := interleave([]net.IP{
+        net.ParseIP("192.0.2.1"),
+        net.ParseIP("192.0.2.2"),
+        net.ParseIP("192.0.2.3"),
+        net.ParseIP("2001:db8::1"),
+    })
+    var expect = []string{"2001:db8::1", "192.0.2.1", "192.0.2.2", "192.0.2.3"}
+    for i := range expect {
+        if ips[i].String() != expect[i] {
+            t.Fatalf("%d: expected %s, got %s", i, expect[i], ips[i])
+        }
+    }
+}
@@ -0,0 +1,65 @@
+//go:build go1.18
+
+package surface
+
+import (
+    "github.com/devguardio/identity/go"
+    "testing"
+    "bytes"
+    "net"
+    "time"
+)
+
+// seeds for FuzzParse
+func fuzzSeeds(t testing.TB) [][]byte {
+    var doc = Surface{Serial: 300, Precedent: 299, Time: time.Unix(1650000000, 0)}
+    doc.Ingress(0).Name         = "s1.ingress.devguard.io"
+    doc.Ingress(0).IP           = []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}
+    doc.Ingress(0).Identity     = &identity.Identity{1, 2, 3}
+    doc.Ingress(15).Port        = 8443
+    doc.Ingress(15).Protocols   = []string{"h2", "http/1.1"}
+
+    plain := serialize(t, &doc)
+
+    doc.Signature = &identity.Signature{4, 5, 6}
+    signed := serialize(t, &doc)
+
+    doc.Unknown = []byte{0x81, 3, 'a', 'b', 'c'}
+    unknown := serialize(t, &doc)
+
+    doc.Version = 2
+    doc.Ingress(40).Name = "s40.ingress.devguard.io"
+    v2 := serialize(t, &doc)
+
+    return [][]byte{
+        plain,
+        signed,
+        unknown,
+        v2,
+        plain[:40],
+        []byte("S1"),
+        []byte("S1\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff"),
+    }
+}
+
+// Parse must not panic on anything a network can send,
+// and whatever it accepts must serialize into a document it parses back the same way
+func FuzzParse(f *testing.F) {
+    for _, seed := range fuzzSeeds(f) {
+        f.Add(seed)
+    }
+
+    f.Fuzz(func(t *testing.T, b []byte) {
+        doc, err := Parse(b)
+        if err != nil { return }
+
+        b2 := serialize(t, doc)
+        doc2, err := Parse(b2)
+        if err != nil {
+            t.Fatalf("cannot parse own serialization: %v", err)
+        }
+        if !bytes.Equal(serialize(t, doc2), b2) {
+            t.Fatal("serialization is not stable")
+        }
+    })
+}
@@ -0,0 +1,223 @@
+package surface
+
+import (
+    "net"
+    "sort"
+    "sync"
+    "time"
+    "encoding/json"
+)
+
+// first backoff after a failure, doubled with every consecutive failure up to maxBackoff
+const (
+    minBackoff = 10 * time.Second
+    maxBackoff = 10 * time.Minute
+)
+
+// EndpointHealth is what we know about an ingress or one of its addresses
+type EndpointHealth struct {
+    Successes       uint64          `json:",omitempty"`
+    Failures        uint64          `json:",omitempty"`
+
+    // failures since the last success
+    Consecutive     uint64          `json:",omitempty"`
+
+    // smoothed time to a verified connection
+    Latency         time.Duration   `json:",omitempty"`
+
+    LastSuccess     time.Time
+    LastFailure     time.Time
+}
+
+// BackoffUntil returns when the endpoint should be tried again after consecutive failures
+func (self *EndpointHealth) BackoffUntil() time.Time {
+    if self.Consecutive == 0 {
+        return time.Time{}
+    }
+    var backoff = minBackoff
+    for i := uint64(1); i < self.Consecutive && backoff < maxBackoff; i++ {
+        backoff *= 2
+    }
+    if backoff > maxBackoff {
+        backoff = maxBackoff
+    }
+    return self.LastFailure.Add(backoff)
+}
+
+func (self *EndpointHealth) success(latency time.Duration) {
+    self.Successes   += 1
+    self.Consecutive  = 0
+    self.LastSuccess  = time.Now()
+    if self.Latency == 0 {
+        self.Latency = latency
+    } else {
+        self.Latency = (self.Latency * 7 + latency) / 8
+    }
+}
+
+func (self *EndpointHealth) failure() {
+    self.Failures    += 1
+    self.Consecutive += 1
+    self.LastFailure  = time.Now()
+}
+
+// Health remembers how well ingresses and their addresses worked across dials.
+//
+// ingresses are keyed by name, since the name is the part of an ingress that stays the same across documents.
+// it can be marshaled to json and restored, so it survives restarts.
+type Health struct {
+    mu          sync.Mutex
+    ingresses   map[string]*EndpointHealth
+    addresses   map[string]*EndpointHealth
+}
+
+func NewHealth() *Health {
+    return &Health{
+        ingresses:  make(map[string]*EndpointHealth),
+        addresses:  make(map[string]*EndpointHealth),
+    }
+}
+
+type healthJSON struct {
+    Ingresses   map[string]*EndpointHealth
+    Addresses   map[string]*EndpointHealth
+}
+
+func (self *Health) MarshalJSON() ([]byte, error) {
+    self.mu.Lock()
+    defer self.mu.Unlock()
+    return json.Marshal(healthJSON{
+        Ingresses:  self.ingresses,
+        Addresses:  self.addresses,
+    })
+}
+
+func (self *Health) UnmarshalJSON(b []byte) error {
+    var v healthJSON
+    err := json.Unmarshal(b, &v)
+    if err != nil { return err }
+
+    self.mu.Lock()
+    defer self.mu.Unlock()
+    self.ingresses  = v.Ingresses
+    self.addresses  = v.Addresses
+    if self.ingresses == nil {
+        self.ingresses = make(map[string]*EndpointHealth)
+    }
+    if self.addresses == nil {
+        self.addresses = make(map[string]*EndpointHealth)
+    }
+    return nil
+}
+
+// Ingress returns a copy of what is known about an ingress
+func (self *Health) Ingress(name string) EndpointHealth {
+    self.mu.Lock()
+    defer self.mu.Unlock()
+    if h := self.ingresses[name]; h != nil {
+        return *h
+    }
+    return EndpointHealth{}
+}
+
+// Address returns a copy of what is known about an address
+func (self *Health) Address(ip net.IP) EndpointHealth {
+    self.mu.Lock()
+    defer self.mu.Unlock()
+    if h := self.addresses[ip.String()]; h != nil {
+        return *h
+    }
+    return EndpointHealth{}
+}
+
+func (self *Health) get(m map[string]*EndpointHealth, key string) *EndpointHealth {
+    h := m[key]
+    if h == nil {
+        h = &EndpointHealth{}
+        m[key] = h
+    }
+    return h
+}
+
+func (self *Health) IngressSuccess(name string, latency time.Duration) {
+    self.mu.Lock()
+    defer self.mu.Unlock()
+    self.get(self.ingresses, name).success(latency)
+}
+
+func (self *Health) IngressFailure(name string) {
+    self.mu.Lock()
+    defer self.mu.Unlock()
+    self.get(self.ingresses, name).failure()
+}
+
+func (self *Health) AddressSuccess(ip net.IP, latency time.Duration) {
+    self.mu.Lock()
+    defer self.mu.Unlock()
+    self.get(self.addresses, ip.String()).success(latency)
+}
+
+func (self *Health) AddressFailure(ip net.IP) {
+    self.mu.Lock()
+    defer self.mu.Unlock()
+    self.get(self.addresses, ip.String()).failure()
+}
+
+// OrderIngresses returns ingress indexes in the order they should be tried.
+//
+// this is index order, except that ingresses still backing off from consecutive failures are moved to the end,
+// where they keep their index order too. so a broken primary doesn't delay every dial,
+// but is still tried before giving up.
+func (self *Health) OrderIngresses(names []string) []int {
+    self.mu.Lock()
+    defer self.mu.Unlock()
+
+    var now = time.Now()
+    var ready, later []int
+    for i, name := range names {
+        if h := self.ingresses[name]; h != nil && now.Before(h.BackoffUntil()) {
+            later = append(later, i)
+        } else {
+            ready = append(ready, i)
+        }
+    }
+    return append(ready, later...)
+}
+
+// OrderAddresses sorts the addresses of one ingress in the order they should be tried.
+//
+// addresses that worked before come first, most recently working first.
+// then addresses we know nothing about, in the given order.
+// last the ones backing off from consecutive failures, the ones to be retried soonest first.
+func (self *Health) OrderAddresses(ips []net.IP) []net.IP {
+    self.mu.Lock()
+    defer self.mu.Unlock()
+
+    var now = time.Now()
+    var good, unknown, failing []net.IP
+    for _, ip := range ips {
+        h := self.addresses[ip.String()]
+        if h == nil {
+            unknown = append(unknown, ip)
+        } else if now.Before(h.BackoffUntil()) {
+            failing = append(failing, ip)
+        } else if h.Successes > 0 && h.Consecutive == 0 {
+            good = append(good, ip)
+        } else {
+            unknown = append(unknown, ip)
+        }
+    }
+
+    sort.SliceStable(good, func(i, j int) bool {
+        return self.addresses[good[i].String()].LastSuccess.After(self.addresses[good[j].String()].LastSuccess)
+    })
+    sort.SliceStable(failing, func(i, j int) bool {
+        return self.addresses[failing[i].String()].BackoffUntil().Before(self.addresses[failing[j].String()].BackoffUntil())
+    })
+
+    var r = make([]net.IP, 0, len(ips))
+    r = append(r, good...)
+    r = append(r, unknown...)
+    r = append(r, failing...)
+    return r
+}
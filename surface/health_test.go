@@ -0,0 +1,55 @@
+package surface
+
+import (
+    "testing"
+    "net"
+    "encoding/json"
+    "time"
+)
+
+func TestHealth(t *testing.T) {
+
+    a := net.ParseIP("192.0.2.1")
+    b := net.ParseIP("192.0.2.2")
+    c := net.ParseIP("192.0.2.3")
+
+    health := NewHealth()
+    health.AddressFailure(a)
+    health.AddressSuccess(c, 10 * time.Millisecond)
+
+    ips := health.OrderAddresses([]net.IP{a, b, c})
+    if !ips[0].Equal(c) || !ips[1].Equal(b) || !ips[2].Equal(a) {
+        t.Fatalf("unexpected order %v", ips)
+    }
+
+    health.IngressFailure("primary.devguard.io")
+    order := health.OrderIngresses([]string{"primary.devguard.io", "", "fallback.devguard.io"})
+    if order[0] != 1 || order[1] != 2 || order[2] != 0 {
+        t.Fatalf("unexpected order %v", order)
+    }
+
+    // survives a restart
+    js, err := json.Marshal(health)
+    if err != nil { t.Fatal(err) }
+    restored := NewHealth()
+    err = json.Unmarshal(js, restored)
+    if err != nil { t.Fatal(err) }
+
+    if restored.Address(c).Successes != 1 || restored.Ingress("primary.devguard.io").Consecutive != 1 {
+        t.Fatalf("lost state: %s", js)
+    }
+
+    // backoff grows with consecutive failures, and a success resets it
+    for i := 0; i < 20; i++ {
+        health.AddressFailure(a)
+    }
+    h := health.Address(a)
+    if d := h.BackoffUntil().Sub(h.LastFailure); d != maxBackoff {
+        t.Fatalf("backoff %v", d)
+    }
+    health.AddressSuccess(a, time.Millisecond)
+    h = health.Address(a)
+    if !h.BackoffUntil().IsZero() {
+        t.Fatalf("still backing off after success")
+    }
+}
@@ -0,0 +1,318 @@
+package surface
+
+import (
+    "github.com/devguardio/identity/go"
+    "testing"
+    "net"
+    "net/http"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "context"
+    "errors"
+    "math/big"
+    "time"
+)
+
+// an in-process ingress on loopback that presents the given chain
+func startTestIngress(t *testing.T, chain tls.Certificate) uint16 {
+    ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+        Certificates:   []tls.Certificate{chain},
+        ClientAuth:     tls.RequireAnyClientCert,
+    })
+    if err != nil { t.Fatal(err) }
+    t.Cleanup(func() { ln.Close() })
+
+    go http.Serve(ln, http.NotFoundHandler())
+
+    return uint16(ln.Addr().(*net.TCPAddr).Port)
+}
+
+func testLeaf(t *testing.T, name string, ips []net.IP, parent *x509.Certificate, parentKey interface{}) ([]byte, *ecdsa.PrivateKey) {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil { t.Fatal(err) }
+
+    tpl := &x509.Certificate{
+        SerialNumber:   big.NewInt(2),
+        Subject:        pkix.Name{CommonName: name},
+        DNSNames:       []string{name},
+        IPAddresses:    ips,
+        NotBefore:      time.Now().Add(-time.Hour),
+        NotAfter:       time.Now().Add(time.Hour),
+        KeyUsage:       x509.KeyUsageDigitalSignature,
+        ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+    }
+    der, err := x509.CreateCertificate(rand.Reader, tpl, parent, &key.PublicKey, parentKey)
+    if err != nil { t.Fatal(err) }
+    return der, key
+}
+
+// a self signed leaf for name, which is pinned as is
+func selfSignedLeaf(t *testing.T, name string) (tls.Certificate, *x509.Certificate) {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil { t.Fatal(err) }
+
+    tpl := &x509.Certificate{
+        SerialNumber:   big.NewInt(3),
+        Subject:        pkix.Name{CommonName: name},
+        DNSNames:       []string{name},
+        NotBefore:      time.Now().Add(-time.Hour),
+        NotAfter:       time.Now().Add(time.Hour),
+        KeyUsage:       x509.KeyUsageDigitalSignature,
+        ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+    }
+    der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+    if err != nil { t.Fatal(err) }
+    cert, err := x509.ParseCertificate(der)
+    if err != nil { t.Fatal(err) }
+
+    return tls.Certificate{
+        Certificate:    [][]byte{der},
+        PrivateKey:     key,
+    }, cert
+}
+
+// a leaf for name and ips, signed by a root that is the identity of secret
+func identityChain(t *testing.T, secret *identity.Secret, name string, ips ...net.IP) tls.Certificate {
+    id, err := secret.Identity()
+    if err != nil { t.Fatal(err) }
+
+    tpl, err := id.ToCertificate()
+    if err != nil { t.Fatal(err) }
+    rootDer, err := x509.CreateCertificate(rand.Reader, tpl, tpl, id.ToGo(), secret.ToGo())
+    if err != nil { t.Fatal(err) }
+    root, err := x509.ParseCertificate(rootDer)
+    if err != nil { t.Fatal(err) }
+
+    leafDer, key := testLeaf(t, name, ips, root, secret.ToGo())
+    return tls.Certificate{
+        Certificate:    [][]byte{leafDer, rootDer},
+        PrivateKey:     key,
+    }
+}
+
+// a leaf for name, signed by a fresh ecdsa ca
+func caChain(t *testing.T, name string) (tls.Certificate, *x509.Certificate) {
+    caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil { t.Fatal(err) }
+
+    tpl := &x509.Certificate{
+        SerialNumber:           big.NewInt(1),
+        Subject:                pkix.Name{CommonName: "test ca"},
+        NotBefore:              time.Now().Add(-time.Hour),
+        NotAfter:               time.Now().Add(time.Hour),
+        IsCA:                   true,
+        BasicConstraintsValid:  true,
+        KeyUsage:               x509.KeyUsageCertSign,
+    }
+    caDer, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &caKey.PublicKey, caKey)
+    if err != nil { t.Fatal(err) }
+    ca, err := x509.ParseCertificate(caDer)
+    if err != nil { t.Fatal(err) }
+
+    leafDer, key := testLeaf(t, name, nil, ca, caKey)
+    return tls.Certificate{
+        Certificate:    [][]byte{leafDer},
+        PrivateKey:     key,
+    }, ca
+}
+
+func dialTestIngress(t *testing.T, ingress Ingress) error {
+    return dialTestIngressRoots(t, ingress, nil)
+}
+
+func dialTestIngressRoots(t *testing.T, ingress Ingress, roots *x509.CertPool) error {
+    var sf = Surface{Serial: 1, Time: time.Now(), Ingresses: []Ingress{ingress}}
+
+    dialer := NewDialer(identity.Vault(), &sf)
+    dialer.Resolver = StaticResolver{}
+    dialer.Roots    = roots
+
+    ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+    defer cancel()
+
+    conn, _, err := dialer.DialContext(ctx)
+    if err != nil { return err }
+    conn.Close()
+    return nil
+}
+
+func TestIngressTrust(t *testing.T) {
+
+    const name = "ingress.test"
+    loopback := []net.IP{net.ParseIP("127.0.0.1")}
+
+    secret, err := identity.CreateSecret()
+    if err != nil { t.Fatal(err) }
+    id, err := secret.Identity()
+    if err != nil { t.Fatal(err) }
+
+    other, err := identity.CreateSecret()
+    if err != nil { t.Fatal(err) }
+    otherId, err := other.Identity()
+    if err != nil { t.Fatal(err) }
+
+    caPinned, ca := caChain(t, name)
+
+    identityPort    := startTestIngress(t, identityChain(t, secret, name))
+    caPort          := startTestIngress(t, caPinned)
+    wrongNamePort   := startTestIngress(t, identityChain(t, secret, "other.test"))
+    ipSanPort       := startTestIngress(t, identityChain(t, secret, "other.test", loopback[0]))
+    otherIpSanPort  := startTestIngress(t, identityChain(t, secret, "other.test", net.ParseIP("192.0.2.1")))
+
+    t.Run("identity", func(t *testing.T) {
+        err := dialTestIngress(t, Ingress{Name: name, IP: loopback, Port: identityPort, Identity: id})
+        if err != nil { t.Fatal(err) }
+    })
+
+    t.Run("cert", func(t *testing.T) {
+        err := dialTestIngress(t, Ingress{Name: name, IP: loopback, Port: caPort, Certs: []*x509.Certificate{ca}})
+        if err != nil { t.Fatal(err) }
+    })
+
+    t.Run("pinned leaf", func(t *testing.T) {
+        chain, leaf := selfSignedLeaf(t, name)
+        port := startTestIngress(t, chain)
+        err := dialTestIngress(t, Ingress{Name: name, IP: loopback, Port: port, Certs: []*x509.Certificate{leaf}})
+        if err != nil { t.Fatal(err) }
+    })
+
+    t.Run("mixed", func(t *testing.T) {
+        for _, port := range []uint16{identityPort, caPort} {
+            err := dialTestIngress(t, Ingress{Name: name, IP: loopback, Port: port, Identity: id, Certs: []*x509.Certificate{ca}})
+            if err != nil { t.Fatal(err) }
+        }
+    })
+
+    t.Run("dialer roots", func(t *testing.T) {
+        roots := x509.NewCertPool()
+        roots.AddCert(ca)
+
+        err := dialTestIngressRoots(t, Ingress{Name: name, IP: loopback, Port: caPort}, roots)
+        if err != nil { t.Fatal(err) }
+
+        err = dialTestIngress(t, Ingress{Name: name, IP: loopback, Port: caPort})
+        if err == nil {
+            t.Fatal("verified an ingress without any trust")
+        }
+
+        // pinned ingresses don't fall back to the dialer roots
+        err = dialTestIngressRoots(t, Ingress{Name: name, IP: loopback, Port: caPort, Identity: otherId}, roots)
+        if err == nil {
+            t.Fatal("dialer roots replaced the pinned identity")
+        }
+    })
+
+    t.Run("wrong identity", func(t *testing.T) {
+        err := dialTestIngress(t, Ingress{Name: name, IP: loopback, Port: identityPort, Identity: otherId})
+        var dialErr *DialError
+        if !errors.As(err, &dialErr) || len(dialErr.Phase(PhaseVerify)) != 1 {
+            t.Fatalf("expected verify failure, got %v", err)
+        }
+    })
+
+    t.Run("identity is not a cert", func(t *testing.T) {
+        err := dialTestIngress(t, Ingress{Name: name, IP: loopback, Port: caPort, Identity: id})
+        var dialErr *DialError
+        if !errors.As(err, &dialErr) || len(dialErr.Phase(PhaseVerify)) != 1 {
+            t.Fatalf("expected verify failure, got %v", err)
+        }
+    })
+
+    t.Run("ip san", func(t *testing.T) {
+        err := dialTestIngress(t, Ingress{Name: name, IP: loopback, Port: ipSanPort, Identity: id})
+        if err != nil { t.Fatal(err) }
+    })
+
+    t.Run("wrong ip san", func(t *testing.T) {
+        err := dialTestIngress(t, Ingress{Name: name, IP: loopback, Port: otherIpSanPort, Identity: id})
+        var hostErr x509.HostnameError
+        if !errors.As(err, &hostErr) {
+            t.Fatalf("expected hostname error, got %v", err)
+        }
+    })
+
+    t.Run("ip only", func(t *testing.T) {
+        err := dialTestIngress(t, Ingress{IP: loopback, Port: ipSanPort, Identity: id})
+        if err != nil { t.Fatal(err) }
+    })
+
+    t.Run("ip only, wrong ip san", func(t *testing.T) {
+        err := dialTestIngress(t, Ingress{IP: loopback, Port: otherIpSanPort, Identity: id})
+        var hostErr x509.HostnameError
+        if !errors.As(err, &hostErr) || hostErr.Host != "127.0.0.1" {
+            t.Fatalf("expected hostname error for 127.0.0.1, got %v", err)
+        }
+    })
+
+    t.Run("wrong name", func(t *testing.T) {
+        err := dialTestIngress(t, Ingress{Name: name, IP: loopback, Port: wrongNamePort, Identity: id})
+        var hostErr x509.HostnameError
+        if !errors.As(err, &hostErr) {
+            t.Fatalf("expected hostname error, got %v", err)
+        }
+    })
+}
+
+func TestDialerProtocols(t *testing.T) {
+
+    const name = "ingress.test"
+    loopback := []net.IP{net.ParseIP("127.0.0.1")}
+
+    secret, err := identity.CreateSecret()
+    if err != nil { t.Fatal(err) }
+    id, err := secret.Identity()
+    if err != nil { t.Fatal(err) }
+
+    ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+        Certificates:   []tls.Certificate{identityChain(t, secret, name)},
+        ClientAuth:     tls.RequireAnyClientCert,
+        NextProtos:     []string{"h2"},
+    })
+    if err != nil { t.Fatal(err) }
+    defer ln.Close()
+    go func() {
+        for {
+            conn, err := ln.Accept()
+            if err != nil { return }
+            go conn.(*tls.Conn).Handshake()
+        }
+    }()
+    port := uint16(ln.Addr().(*net.TCPAddr).Port)
+
+    ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+    defer cancel()
+
+    t.Run("none in common", func(t *testing.T) {
+        var sf = Surface{Serial: 1, Time: time.Now(), Ingresses: []Ingress{{Name: name, IP: loopback, Port: port, Identity: id, Protocols: []string{"h2"}}}}
+        dialer := NewDialer(identity.Vault(), &sf)
+        dialer.Resolver = StaticResolver{}
+
+        _, _, err := dialer.DialContext(ctx)
+        var dialErr *DialError
+        if !errors.As(err, &dialErr) || len(dialErr.Phase(PhaseALPN)) != 1 || !errors.Is(err, ErrNoProtocol) {
+            t.Fatalf("expected alpn failure, got %v", err)
+        }
+    })
+
+    t.Run("update skipped on h2", func(t *testing.T) {
+        var sf = Surface{Serial: 1, Time: time.Now(), Ingresses: []Ingress{{Name: name, IP: loopback, Port: port, Identity: id, Protocols: []string{"h2"}}}}
+        dialer := NewDialer(identity.Vault(), &sf)
+        dialer.Resolver     = StaticResolver{}
+        dialer.Protocols    = []string{"h2", "http/1.1"}
+        dialer.Updater      = &Updater{}
+        dialer.Clock        = &Clock{}
+
+        conn, _, err := dialer.DialContext(ctx)
+        if err != nil { t.Fatal(err) }
+        conn.Close()
+
+        if len(dialer.Warnings) != 2 || !errors.Is(dialer.Warnings[0], ErrNotHTTP1) ||
+            dialer.Warnings[0].Phase != PhaseUpdate || dialer.Warnings[1].Phase != PhaseTime {
+            t.Fatalf("expected skipped update and time sync in warnings, got %v", dialer.Warnings)
+        }
+    })
+}
@@ -0,0 +1,135 @@
+package surface
+
+import (
+    "github.com/devguardio/identity/go"
+    "github.com/ghodss/yaml"
+    "encoding/base64"
+    "encoding/json"
+    "encoding/pem"
+    "crypto/x509"
+    "bytes"
+    "net"
+    "fmt"
+    "time"
+)
+
+/*
+FromJSON reads a document in the shape that json.Marshal of a Surface prints, as in `surface dump`.
+Certs can be given as PEM (one or more CERTIFICATE blocks), as base64 DER
+or as the json object of a x509.Certificate, of which only Raw is used.
+
+The document is not verified. A Signature is kept, but only matches if the json is an unedited dump.
+*/
+func FromJSON(b []byte) (*Surface, error) {
+
+    var js jsonSurface
+
+    dec := json.NewDecoder(bytes.NewReader(b))
+    dec.DisallowUnknownFields()
+    if err := dec.Decode(&js); err != nil { return nil, err }
+
+    if len(js.Ingresses) > MaxIngresses {
+        return nil, fmt.Errorf("%w: %d ingresses, at most %d are supported", ErrTooLarge, len(js.Ingresses), MaxIngresses)
+    }
+
+    var doc = &Surface{
+        Version:    js.Version,
+        Serial:     js.Serial,
+        Precedent:  js.Precedent,
+        Time:       js.Time,
+        Signature:  js.Signature,
+        Unknown:    js.Unknown,
+        Ingresses:  make([]Ingress, len(js.Ingresses)),
+    }
+    if js.Sequencer != nil {
+        doc.Sequencer = *js.Sequencer
+    }
+
+    for i, ingress := range js.Ingresses {
+        doc.Ingresses[i] = Ingress{
+            Name:       ingress.Name,
+            Identity:   ingress.Identity,
+            IP:         ingress.IP,
+            Port:       ingress.Port,
+            Protocols:  ingress.Protocols,
+        }
+        for _, certs := range ingress.Certs {
+            doc.Ingresses[i].Certs = append(doc.Ingresses[i].Certs, certs...)
+        }
+    }
+
+    return doc, nil
+}
+
+// FromYAML is FromJSON for the same shape written as yaml
+func FromYAML(b []byte) (*Surface, error) {
+    js, err := yaml.YAMLToJSON(b)
+    if err != nil { return nil, err }
+    return FromJSON(js)
+}
+
+type jsonIngress struct {
+    Name        string
+    Identity    *identity.Identity
+    Certs       []jsonCerts
+    IP          []net.IP
+    Port        uint16
+    Protocols   []string
+}
+
+type jsonSurface struct {
+    Version     uint8
+    Serial      identity.Serial
+    Precedent   identity.Serial
+    Sequencer   *identity.Identity
+    Time        time.Time
+    Ingresses   []jsonIngress
+    Signature   *identity.Signature
+    Unknown     []byte
+}
+
+// one entry in Certs. a PEM string may hold a whole chain
+type jsonCerts []*x509.Certificate
+
+func (self *jsonCerts) UnmarshalJSON(b []byte) error {
+
+    var s string
+    if err := json.Unmarshal(b, &s); err != nil {
+
+        // what json.Marshal prints for a x509.Certificate
+        var obj struct {
+            Raw []byte
+        }
+        if err := json.Unmarshal(b, &obj); err != nil { return fmt.Errorf("cert: %w", err) }
+        if len(obj.Raw) == 0 { return fmt.Errorf("cert: object has no Raw") }
+
+        cert, err := x509.ParseCertificate(obj.Raw)
+        if err != nil { return fmt.Errorf("cert: %w", err) }
+        *self = jsonCerts{cert}
+        return nil
+    }
+
+    if bytes.Contains([]byte(s), []byte("-----BEGIN")) {
+        rest := []byte(s)
+        for {
+            var block *pem.Block
+            block, rest = pem.Decode(rest)
+            if block == nil { break }
+            if block.Type != "CERTIFICATE" { continue }
+
+            cert, err := x509.ParseCertificate(block.Bytes)
+            if err != nil { return fmt.Errorf("cert: %w", err) }
+            *self = append(*self, cert)
+        }
+        if len(*self) == 0 { return fmt.Errorf("cert: no CERTIFICATE in pem") }
+        return nil
+    }
+
+    der, err := base64.StdEncoding.DecodeString(s)
+    if err != nil { return fmt.Errorf("cert: neither pem nor base64: %w", err) }
+
+    cert, err := x509.ParseCertificate(der)
+    if err != nil { return fmt.Errorf("cert: %w", err) }
+    *self = jsonCerts{cert}
+    return nil
+}
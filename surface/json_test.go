@@ -0,0 +1,88 @@
+package surface
+
+import (
+    "github.com/devguardio/identity/go"
+    "testing"
+    "net"
+    "bytes"
+    "fmt"
+    "strings"
+    "encoding/base64"
+    "encoding/json"
+    "encoding/pem"
+    "time"
+)
+
+func TestFromJSON(t *testing.T) {
+
+    secret1, err := identity.CreateSecret()
+    if err != nil { t.Fatal(err) }
+    seq1, err := secret1.Identity()
+    if err != nil { t.Fatal(err) }
+
+    chain, ca := caChain(t, "s1.ingress.devguard.io")
+
+    var genesis = Surface{Serial: 1, Time: time.Now(), Sequencer: *seq1}
+    genesis.Ingress(0).Name = "s1.ingress.devguard.io"
+
+    next, _, err := genesis.Next(time.Now())
+    if err != nil { t.Fatal(err) }
+    next.Ingresses[0].IP        = []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}
+    next.Ingresses[0].Port      = 8443
+    next.Ingresses[0].Protocols = []string{"h2", "http/1.1"}
+    next.Ingresses[0].Certs     = append(next.Ingresses[0].Certs, ca)
+    err = next.Sign(secret1)
+    if err != nil { t.Fatal(err) }
+
+    parsed, err := Parse(serialize(t, next))
+    if err != nil { t.Fatal(err) }
+
+    // what surface dump prints reads back into the same document
+    dump, err := json.Marshal(parsed)
+    if err != nil { t.Fatal(err) }
+
+    back, err := FromJSON(dump)
+    if err != nil { t.Fatal(err) }
+    if !bytes.Equal(serialize(t, back), serialize(t, next)) {
+        t.Fatal("dump did not read back into the same document")
+    }
+    if err = back.Verify(&genesis); err != nil {
+        t.Fatal(err)
+    }
+
+    // certs as pem chain and as base64 der
+    leafPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: chain.Certificate[0]})
+    caPem   := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})
+    pemJson, _ := json.Marshal(string(leafPem) + string(caPem))
+
+    js := fmt.Sprintf(`{"Serial": 3, "Precedent": 2, "Ingresses": [{}, {"Name": "x", "Certs": [%s, "%s"]}]}`,
+        pemJson, base64.StdEncoding.EncodeToString(ca.Raw))
+
+    doc, err := FromJSON([]byte(js))
+    if err != nil { t.Fatal(err) }
+    if len(doc.Ingresses[1].Certs) != 3 {
+        t.Fatalf("expected 3 certs, got %d", len(doc.Ingresses[1].Certs))
+    }
+    if !bytes.Equal(doc.Ingresses[1].Certs[0].Raw, chain.Certificate[0]) || !bytes.Equal(doc.Ingresses[1].Certs[2].Raw, ca.Raw) {
+        t.Fatal("certs read back in wrong order")
+    }
+
+    // same thing as yaml
+    yml := "Serial: 3\nPrecedent: 2\nIngresses:\n- Name: x\n  Certs:\n  - |\n    " +
+        strings.ReplaceAll(strings.TrimSpace(string(caPem)), "\n", "\n    ") + "\n"
+    doc, err = FromYAML([]byte(yml))
+    if err != nil { t.Fatal(err) }
+    if doc.Serial != 3 || doc.Ingresses[0].Name != "x" || len(doc.Ingresses[0].Certs) != 1 {
+        t.Fatalf("yaml read wrong: %+v", doc.Ingresses[0])
+    }
+
+    // typos are errors, not silently dropped ingresses
+    _, err = FromJSON([]byte(`{"Serial": 3, "Ingresses": [{"Names": "x"}]}`))
+    if err == nil {
+        t.Fatal("accepted unknown field")
+    }
+    _, err = FromJSON([]byte(`{"Ingresses": [{"Certs": ["not a cert"]}]}`))
+    if err == nil {
+        t.Fatal("accepted garbage cert")
+    }
+}
@@ -0,0 +1,212 @@
+package surface
+
+import (
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/hex"
+    "fmt"
+    "time"
+)
+
+// the largest version 1 document, including its signature. older carriers refuse larger ones
+const MaxDocumentSize = 32767
+
+// the largest version 2 document, including its signature
+const MaxDocumentSizeV2 = 1 << 20
+
+// the largest certificate Serialize writes
+const MaxCertSize = 16000
+
+// Validate returns the reasons a device would refuse or misuse the document.
+// if prev is not nil, the document must also be a signed successor of it.
+func (doc *Surface) Validate(prev *Surface) []error {
+    var errs []error
+
+    if prev != nil {
+        if err := doc.Verify(prev); err != nil {
+            errs = append(errs, err)
+        }
+    }
+
+    if doc.Serial <= doc.Precedent {
+        errs = append(errs, fmt.Errorf("serial %d must be larger than precedent %d", doc.Serial, doc.Precedent))
+    }
+
+    if doc.Time.IsZero() || doc.Time.Unix() <= 0 {
+        errs = append(errs, fmt.Errorf("time is not set, devices will fall back to their system clock"))
+    }
+
+    if _, err := doc.Serialize(); err != nil {
+        errs = append(errs, err)
+    }
+
+    for i, ingress := range doc.Ingresses {
+        for _, cert := range ingress.Certs {
+            if doc.Time.After(cert.NotAfter) {
+                errs = append(errs, fmt.Errorf("ingress %d: cert %s expired at %s, before the document time",
+                    i, certName(cert), cert.NotAfter.Format(time.RFC3339)))
+            }
+        }
+    }
+
+    return errs
+}
+
+// Lint returns mistakes that Serialize or the Dialer silently work around
+func (doc *Surface) Lint() []string {
+    var r []string
+
+    var usable = 0
+    for i, ingress := range doc.Ingresses {
+        var hasFields = ingress.Identity != nil || len(ingress.Certs) > 0 ||
+            ingress.Port != 0 || len(ingress.Protocols) > 0
+
+        // one without a name is dialed by its ips
+        if ingress.Name == "" && len(ingress.IP) == 0 {
+            if hasFields {
+                r = append(r, fmt.Sprintf("ingress %d has no name and no ips and will never be dialed", i))
+            }
+            continue
+        }
+        usable += 1
+
+        if ingress.Identity == nil && len(ingress.Certs) == 0 {
+            r = append(r, fmt.Sprintf("ingress %d: no identity and no certs, it can only be verified by a dialer with Roots", i))
+        }
+        for _, cert := range ingress.Certs {
+            if doc.Time.Before(cert.NotBefore) {
+                r = append(r, fmt.Sprintf("ingress %d: cert %s is not valid until %s, after the document time",
+                    i, certName(cert), cert.NotBefore.Format(time.RFC3339)))
+            }
+        }
+        for _, proto := range ingress.Protocols {
+            if proto != "h2" && proto != "http/1.1" {
+                r = append(r, fmt.Sprintf("ingress %d: alpn %q is neither h2 nor http/1.1", i, proto))
+            }
+        }
+    }
+
+    if usable == 0 {
+        r = append(r, "no ingress has a name or ips, devices can't connect anywhere")
+    }
+
+    if doc.version() > 1 {
+        r = append(r, fmt.Sprintf("document is version %d, carriers that only read version 1 will refuse it", doc.Version))
+    }
+
+    var zero [32]byte
+    if doc.Sequencer == zero {
+        r = append(r, "sequencer is not set, the chain can't be extended")
+    }
+
+    return r
+}
+
+// Diff returns the ingress level changes from a to b
+func Diff(a, b *Surface) []string {
+    var r []string
+
+    if a.version() != b.version() {
+        r = append(r, fmt.Sprintf("version %d -> %d", a.version(), b.version()))
+    }
+    if a.Serial != b.Serial {
+        r = append(r, fmt.Sprintf("serial %d -> %d", a.Serial, b.Serial))
+    }
+    if a.Precedent != b.Precedent {
+        r = append(r, fmt.Sprintf("precedent %d -> %d", a.Precedent, b.Precedent))
+    }
+    if !a.Time.Equal(b.Time) {
+        r = append(r, fmt.Sprintf("time %s -> %s", a.Time.Format(time.RFC3339), b.Time.Format(time.RFC3339)))
+    }
+    if !a.Sequencer.Equal(&b.Sequencer) {
+        r = append(r, fmt.Sprintf("sequencer %s -> %s", a.Sequencer.String(), b.Sequencer.String()))
+    }
+
+    for i := 0; i < len(a.Ingresses) || i < len(b.Ingresses); i++ {
+        var ia, ib Ingress
+        if i < len(a.Ingresses) {
+            ia = a.Ingresses[i]
+        }
+        if i < len(b.Ingresses) {
+            ib = b.Ingresses[i]
+        }
+        r = append(r, diffIngress(i, &ia, &ib)...)
+    }
+
+    return r
+}
+
+func diffIngress(i int, a, b *Ingress) []string {
+    var r []string
+
+    if a.Name != b.Name {
+        r = append(r, fmt.Sprintf("ingress %d: name %q -> %q", i, a.Name, b.Name))
+    }
+
+    var ida, idb string
+    if a.Identity != nil {
+        ida = a.Identity.String()
+    }
+    if b.Identity != nil {
+        idb = b.Identity.String()
+    }
+    if ida != idb {
+        r = append(r, fmt.Sprintf("ingress %d: identity %q -> %q", i, ida, idb))
+    }
+
+    var ipsa, ipsb []string
+    for _, ip := range a.IP {
+        ipsa = append(ipsa, ip.String())
+    }
+    for _, ip := range b.IP {
+        ipsb = append(ipsb, ip.String())
+    }
+    r = append(r, diffSet(fmt.Sprintf("ingress %d: ip", i), ipsa, ipsb)...)
+
+    var certsa, certsb []string
+    for _, cert := range a.Certs {
+        certsa = append(certsa, certName(cert))
+    }
+    for _, cert := range b.Certs {
+        certsb = append(certsb, certName(cert))
+    }
+    r = append(r, diffSet(fmt.Sprintf("ingress %d: cert", i), certsa, certsb)...)
+
+    if a.Port != b.Port {
+        r = append(r, fmt.Sprintf("ingress %d: port %d -> %d", i, a.Port, b.Port))
+    }
+    if fmt.Sprint(a.Protocols) != fmt.Sprint(b.Protocols) {
+        r = append(r, fmt.Sprintf("ingress %d: alpn %v -> %v", i, a.Protocols, b.Protocols))
+    }
+
+    return r
+}
+
+func diffSet(prefix string, a, b []string) []string {
+    var r []string
+    var ina = make(map[string]bool)
+    var inb = make(map[string]bool)
+    for _, v := range a {
+        ina[v] = true
+    }
+    for _, v := range b {
+        inb[v] = true
+    }
+    for _, v := range a {
+        if !inb[v] {
+            r = append(r, fmt.Sprintf("%s - %s", prefix, v))
+        }
+    }
+    for _, v := range b {
+        if !ina[v] {
+            r = append(r, fmt.Sprintf("%s + %s", prefix, v))
+        }
+    }
+    return r
+}
+
+// subject and a short fingerprint, since subjects alone are often the same across rotations
+func certName(cert *x509.Certificate) string {
+    sum := sha256.Sum256(cert.Raw)
+    return fmt.Sprintf("%q (%s)", cert.Subject.CommonName, hex.EncodeToString(sum[:6]))
+}
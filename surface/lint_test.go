@@ -0,0 +1,52 @@
+package surface
+
+import (
+    "testing"
+    "crypto/x509"
+    "net"
+    "strings"
+    "time"
+)
+
+func TestLintDiff(t *testing.T) {
+
+    var a = Surface{Serial: 2, Precedent: 1, Time: time.Now()}
+    a.Ingress(0).Name = "s2.ingress.devguard.io"
+    a.Ingress(2).IP   = []net.IP{net.ParseIP("192.0.2.1")}
+    a.Ingress(3).Port = 8443
+
+    lint := strings.Join(a.Lint(), "\n")
+    if strings.Contains(lint, "ingress 2 has no name") {
+        t.Fatalf("ingress with only an ip flagged:\n%s", lint)
+    }
+    if !strings.Contains(lint, "ingress 3 has no name and no ips") {
+        t.Fatalf("undialable ingress not found:\n%s", lint)
+    }
+    if !strings.Contains(lint, "ingress 0: no identity and no certs") {
+        t.Fatalf("missing trust not found:\n%s", lint)
+    }
+
+    // a pinned leaf is as good a trust root as a ca
+    _, leaf := selfSignedLeaf(t, "s2.ingress.devguard.io")
+    a.Ingress(0).Certs = []*x509.Certificate{leaf}
+    lint = strings.Join(a.Lint(), "\n")
+    if strings.Contains(lint, "ingress 0") {
+        t.Fatalf("pinned leaf flagged:\n%s", lint)
+    }
+    a.Ingress(0).Certs = nil
+
+    var b = a
+    b.Ingresses = append([]Ingress{}, a.Ingresses...)
+    b.Ingresses[2].Name = "fallback.devguard.io"
+    b.Ingresses[2].IP   = []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}
+
+    diff := strings.Join(Diff(&a, &b), "\n")
+    if diff != "ingress 2: name \"\" -> \"fallback.devguard.io\"\ningress 2: ip + 2001:db8::1" {
+        t.Fatalf("unexpected diff:\n%s", diff)
+    }
+
+    b.Precedent = 2
+    if errs := b.Validate(nil); len(errs) != 1 {
+        t.Fatalf("expected precedent error, got %v", errs)
+    }
+}
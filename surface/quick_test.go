@@ -0,0 +1,191 @@
+package surface
+
+import (
+    "github.com/devguardio/identity/go"
+    "testing"
+    "testing/quick"
+    "math/rand"
+    "crypto/x509"
+    "bytes"
+    "fmt"
+    "net"
+    "reflect"
+    "errors"
+    "time"
+)
+
+// test certs are slow to make, so every random surface picks from the same few
+var quickCerts []*x509.Certificate
+
+// a random document using every record type on any ingress, in either version
+type quickSurface struct {
+    *Surface
+}
+
+func (quickSurface) Generate(r *rand.Rand, size int) reflect.Value {
+    doc := &Surface{
+        Serial:     identity.Serial(r.Uint64()),
+        Precedent:  identity.Serial(r.Uint64()),
+        Time:       time.Unix(r.Int63(), 0),
+    }
+    r.Read(doc.Sequencer[:])
+
+    doc.Ingresses = make([]Ingress, 1 + r.Intn(MaxIngressesV1))
+    if r.Intn(2) == 0 {
+        doc.Version   = 2
+        doc.Ingresses = make([]Ingress, 1 + r.Intn(40))
+    }
+
+    for i := range doc.Ingresses {
+        if r.Intn(3) == 0 { continue }
+        ingress := &doc.Ingresses[i]
+
+        if r.Intn(2) == 0 {
+            name := make([]byte, 1 + r.Intn(255))
+            r.Read(name)
+            ingress.Name = string(name)
+        }
+        if r.Intn(2) == 0 {
+            ingress.Identity = &identity.Identity{}
+            r.Read(ingress.Identity[:])
+        }
+        // parse returns v4 before v6
+        for i := r.Intn(3); i > 0; i-- {
+            ingress.IP = append(ingress.IP, net.IPv4(byte(r.Intn(224)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256))))
+        }
+        for i := r.Intn(3); i > 0; i-- {
+            ip := make(net.IP, 16)
+            r.Read(ip)
+            ip[0] = 0x20
+            ingress.IP = append(ingress.IP, ip)
+        }
+        for i := r.Intn(3); i > 0; i-- {
+            ingress.Certs = append(ingress.Certs, quickCerts[r.Intn(len(quickCerts))])
+        }
+        if r.Intn(2) == 0 {
+            ingress.Port = uint16(1 + r.Intn(0xffff))
+        }
+        for i := r.Intn(3); i > 0; i-- {
+            proto := make([]byte, 1 + r.Intn(16))
+            r.Read(proto)
+            ingress.Protocols = append(ingress.Protocols, string(proto))
+        }
+    }
+
+    if r.Intn(3) == 0 {
+        // a field type this version doesn't know. short enough to never look like an unknown field followed by a signature
+        doc.Unknown = make([]byte, 1 + r.Intn(60))
+        r.Read(doc.Unknown)
+        doc.Unknown[0] = 0x80 | doc.Unknown[0] & 0x0f
+    }
+
+    if r.Intn(2) == 0 {
+        doc.Signature = &identity.Signature{}
+        r.Read(doc.Signature[:])
+    }
+
+    return reflect.ValueOf(quickSurface{doc})
+}
+
+// parse only returns ingresses up to the last one that has a record
+func equalSurface(a, b *Surface) error {
+    if a.version() != b.version() {
+        return fmt.Errorf("version %d <> %d", a.version(), b.version())
+    }
+    if a.Serial != b.Serial || a.Precedent != b.Precedent || a.Sequencer != b.Sequencer {
+        return fmt.Errorf("header differs")
+    }
+    if a.Time.Unix() != b.Time.Unix() {
+        return fmt.Errorf("time %v <> %v", a.Time, b.Time)
+    }
+    if !reflect.DeepEqual(a.Signature, b.Signature) || !bytes.Equal(a.Unknown, b.Unknown) {
+        return fmt.Errorf("signature or unknown fields differ")
+    }
+    for i := 0; i < len(a.Ingresses) || i < len(b.Ingresses); i++ {
+        var x, y Ingress
+        if i < len(a.Ingresses) {
+            x = a.Ingresses[i]
+        }
+        if i < len(b.Ingresses) {
+            y = b.Ingresses[i]
+        }
+        if x.Name != y.Name || x.Port != y.Port || !reflect.DeepEqual(x.Identity, y.Identity) {
+            return fmt.Errorf("ingress %d differs", i)
+        }
+        if len(x.IP) != len(y.IP) || len(x.Certs) != len(y.Certs) || len(x.Protocols) != len(y.Protocols) {
+            return fmt.Errorf("ingress %d: number of records differs", i)
+        }
+        for j := range x.IP {
+            if !x.IP[j].Equal(y.IP[j]) { return fmt.Errorf("ingress %d: ip %v <> %v", i, x.IP[j], y.IP[j]) }
+        }
+        for j := range x.Certs {
+            if !bytes.Equal(x.Certs[j].Raw, y.Certs[j].Raw) { return fmt.Errorf("ingress %d: cert %d differs", i, j) }
+        }
+        for j := range x.Protocols {
+            if x.Protocols[j] != y.Protocols[j] { return fmt.Errorf("ingress %d: protocol %d differs", i, j) }
+        }
+    }
+    return nil
+}
+
+func TestRoundTrip(t *testing.T) {
+
+    for i := len(quickCerts); i < 3; i++ {
+        _, ca := caChain(t, fmt.Sprintf("ca%d.devguard.io", i))
+        quickCerts = append(quickCerts, ca)
+    }
+
+    err := quick.Check(func(in quickSurface) bool {
+        b := serialize(t, in.Surface)
+
+        out, err := Parse(b)
+        if err != nil {
+            t.Log(err)
+            return false
+        }
+        if err := equalSurface(in.Surface, out); err != nil {
+            t.Log(err)
+            return false
+        }
+        return bytes.Equal(serialize(t, out), b)
+    }, &quick.Config{MaxCount: 500})
+    if err != nil { t.Fatal(err) }
+
+    // the smallest document is just a header
+    var empty Surface
+    out, err := Parse(serialize(t, &empty))
+    if err != nil { t.Fatal(err) }
+    if err := equalSurface(&empty, out); err != nil { t.Fatal(err) }
+
+    // v1 can't hold more
+    var many = Surface{Ingresses: make([]Ingress, MaxIngressesV1 + 1)}
+    many.Ingresses[MaxIngressesV1].Name = "s17.ingress.devguard.io"
+    if _, err := many.Serialize(); !errors.Is(err, ErrTooLarge) {
+        t.Fatalf("expected ErrTooLarge for 17 ingresses in v1, got %v", err)
+    }
+    many.Version = 2
+    out, err = Parse(serialize(t, &many))
+    if err != nil { t.Fatal(err) }
+    if err := equalSurface(&many, out); err != nil { t.Fatal(err) }
+
+    // neither truncates a document that is too large
+    for _, version := range []uint8{1, 2} {
+        var large = Surface{Version: version}
+        for i := 0; i < MaxIngressesV1; i++ {
+            for len(large.Ingress(i).Certs) < 3 {
+                large.Ingress(i).Certs = append(large.Ingress(i).Certs, quickCerts...)
+            }
+        }
+        size := len(serialize(t, &large))
+
+        large.Unknown = make([]byte, MaxDocumentSize - size)
+        large.Unknown[0] = 0x80
+        _, err = large.Serialize()
+        if version == 1 && !errors.Is(err, ErrTooLarge) {
+            t.Fatalf("expected ErrTooLarge for %d bytes in v1, got %v", MaxDocumentSize, err)
+        }
+        if version == 2 && err != nil {
+            t.Fatal(err)
+        }
+    }
+}
@@ -0,0 +1,74 @@
+package surface
+
+import (
+    "net"
+    "context"
+    "sync"
+)
+
+// Resolver looks up the addresses of ingress names.
+// *net.Resolver implements it, other implementations can go around networks that hijack dns,
+// for example dns over https through a pinned ingress.
+type Resolver interface {
+    LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+}
+
+// StaticResolver answers from a fixed list of names, like a hosts file
+type StaticResolver map[string][]net.IP
+
+func (self StaticResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+    var r []net.IP
+    for _, ip := range self[host] {
+        switch network {
+            case "ip4":
+                if ip.To4() == nil { continue }
+            case "ip6":
+                if ip.To4() != nil { continue }
+        }
+        r = append(r, ip)
+    }
+    if len(r) == 0 {
+        return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+    }
+    return r, nil
+}
+
+// CachingResolver remembers the last good answer for every name,
+// and returns it when the upstream resolver fails, so a dns outage doesn't take ingresses down with it
+type CachingResolver struct {
+    Upstream    Resolver
+
+    mu          sync.Mutex
+    cache       map[string][]net.IP
+}
+
+func NewCachingResolver(upstream Resolver) *CachingResolver {
+    return &CachingResolver{
+        Upstream:   upstream,
+        cache:      make(map[string][]net.IP),
+    }
+}
+
+func (self *CachingResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+    var key = network + "/" + host
+
+    ips, err := self.Upstream.LookupIP(ctx, network, host)
+
+    self.mu.Lock()
+    defer self.mu.Unlock()
+
+    if self.cache == nil {
+        self.cache = make(map[string][]net.IP)
+    }
+
+    if err == nil && len(ips) > 0 {
+        self.cache[key] = ips
+        return ips, nil
+    }
+
+    if cached := self.cache[key]; len(cached) > 0 {
+        return cached, nil
+    }
+
+    return ips, err
+}
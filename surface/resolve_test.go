@@ -0,0 +1,60 @@
+package surface
+
+import (
+    "testing"
+    "net"
+    "context"
+    "errors"
+)
+
+type flakyResolver struct {
+    ips     []net.IP
+    down    bool
+}
+
+func (self *flakyResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+    if self.down {
+        return nil, errors.New("dns is down")
+    }
+    return self.ips, nil
+}
+
+func TestCachingResolver(t *testing.T) {
+
+    upstream := &flakyResolver{ips: []net.IP{net.ParseIP("192.0.2.1")}}
+    resolver := NewCachingResolver(upstream)
+
+    _, err := resolver.LookupIP(context.Background(), "ip", "s1.ingress.devguard.io")
+    if err != nil { t.Fatal(err) }
+
+    upstream.down = true
+
+    ips, err := resolver.LookupIP(context.Background(), "ip", "s1.ingress.devguard.io")
+    if err != nil { t.Fatal(err) }
+    if len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.0.2.1")) {
+        t.Fatalf("expected cached answer, got %v", ips)
+    }
+
+    _, err = resolver.LookupIP(context.Background(), "ip", "s2.ingress.devguard.io")
+    if err == nil {
+        t.Fatal("answered a name that was never resolved")
+    }
+}
+
+func TestStaticResolver(t *testing.T) {
+    resolver := StaticResolver{
+        "s1.ingress.devguard.io": {net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")},
+    }
+
+    ips, err := resolver.LookupIP(context.Background(), "ip6", "s1.ingress.devguard.io")
+    if err != nil { t.Fatal(err) }
+    if len(ips) != 1 || ips[0].To4() != nil {
+        t.Fatalf("expected only the v6 address, got %v", ips)
+    }
+
+    _, err = resolver.LookupIP(context.Background(), "ip", "s2.ingress.devguard.io")
+    var dnsErr *net.DNSError
+    if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+        t.Fatalf("expected not found, got %v", err)
+    }
+}
@@ -0,0 +1,140 @@
+package surface
+
+import (
+    "github.com/devguardio/identity/go"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "errors"
+    "fmt"
+)
+
+var ErrRollback = errors.New("surface document is older than one previously accepted")
+
+// Store persists the surface document a device currently trusts
+type Store interface {
+    Load() (*Surface, error)
+    Save(*Surface) error
+}
+
+// FileStore keeps the document at Path,
+// a copy of the last document that was written and read back successfully at Path + ".good"
+// and the highest serial it ever accepted at Path + ".serial"
+//
+// documents with a serial lower than the highest accepted one are refused on Load and Save,
+// so replacing the file with an older document can't roll a device back to a leaked root.
+// the file at Path may be in any Format, Save always writes it raw.
+type FileStore struct {
+    Path string
+}
+
+func NewFileStore(path string) *FileStore {
+    return &FileStore{
+        Path: path,
+    }
+}
+
+func (self *FileStore) Load() (*Surface, error) {
+
+    highest, err := self.highest()
+    if err != nil { return nil, err }
+
+    doc, err := self.load(self.Path, highest)
+    if err != nil {
+        good, err2 := self.load(self.Path + ".good", highest)
+        if err2 != nil { return nil, err }
+        doc = good
+    }
+
+    if doc.Serial > highest {
+        err = self.setHighest(doc.Serial)
+        if err != nil { return nil, err }
+    }
+
+    return doc, nil
+}
+
+func (self *FileStore) Save(doc *Surface) error {
+
+    highest, err := self.highest()
+    if err != nil { return err }
+
+    if doc.Serial < highest {
+        return fmt.Errorf("%w: %d < %d", ErrRollback, doc.Serial, highest)
+    }
+
+    b, err := doc.Serialize()
+    if err != nil { return err }
+
+    err = writeFileAtomic(self.Path, b)
+    if err != nil { return err }
+
+    // make sure it's actually readable before it becomes the rollback floor
+    _, err = self.load(self.Path, highest)
+    if err != nil { return err }
+
+    err = self.setHighest(doc.Serial)
+    if err != nil { return err }
+
+    return writeFileAtomic(self.Path + ".good", b)
+}
+
+func (self *FileStore) load(path string, highest identity.Serial) (*Surface, error) {
+    b, err := ioutil.ReadFile(path)
+    if err != nil { return nil, err }
+
+    doc, err := Decode(b)
+    if err != nil { return nil, fmt.Errorf("%s: %w", path, err) }
+
+    if doc.Serial < highest {
+        return nil, fmt.Errorf("%s: %w: %d < %d", path, ErrRollback, doc.Serial, highest)
+    }
+
+    return doc, nil
+}
+
+func (self *FileStore) highest() (identity.Serial, error) {
+    b, err := ioutil.ReadFile(self.Path + ".serial")
+    if os.IsNotExist(err) { return 0, nil }
+    if err != nil { return 0, err }
+
+    v, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+    if err != nil { return 0, fmt.Errorf("%s.serial: %w", self.Path, err) }
+
+    return identity.Serial(v), nil
+}
+
+func (self *FileStore) setHighest(serial identity.Serial) error {
+    return writeFileAtomic(self.Path + ".serial", []byte(strconv.FormatUint(uint64(serial), 10) + "\n"))
+}
+
+// write to a temporary file, fsync and rename over path,
+// so a power loss leaves either the old or the new content but never a partial file
+func writeFileAtomic(path string, b []byte) error {
+    tmp := path + ".tmp"
+
+    f, err := os.OpenFile(tmp, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, 0644)
+    if err != nil { return err }
+
+    _, err = f.Write(b)
+    if err == nil {
+        err = f.Sync()
+    }
+    if err2 := f.Close(); err == nil {
+        err = err2
+    }
+    if err != nil {
+        os.Remove(tmp)
+        return err
+    }
+
+    err = os.Rename(tmp, path)
+    if err != nil { return err }
+
+    dir, err := os.Open(filepath.Dir(path))
+    if err != nil { return err }
+    defer dir.Close()
+    return dir.Sync()
+}
@@ -0,0 +1,50 @@
+package surface
+
+import (
+    "testing"
+    "io/ioutil"
+    "path/filepath"
+    "errors"
+    "time"
+)
+
+func TestFileStore(t *testing.T) {
+
+    path := filepath.Join(t.TempDir(), "surface")
+    store := NewFileStore(path)
+
+    var old = Surface{Serial: 3, Time: time.Now()}
+    var cur = Surface{Serial: 5, Time: time.Now()}
+    old.Ingress(0).Name = "s3.ingress.devguard.io"
+    cur.Ingress(0).Name = "s5.ingress.devguard.io"
+
+    err := store.Save(&cur)
+    if err != nil { t.Fatal(err) }
+
+    doc, err := store.Load()
+    if err != nil { t.Fatal(err) }
+    if doc.Serial != 5 || doc.Ingresses[0].Name != cur.Ingresses[0].Name {
+        t.Fatalf("loaded wrong document %d", doc.Serial)
+    }
+
+    err = store.Save(&old)
+    if !errors.Is(err, ErrRollback) {
+        t.Fatalf("expected rollback error, got %v", err)
+    }
+
+    // replaced behind our back: fall back to the known-good copy
+    err = ioutil.WriteFile(path, serialize(t, &old), 0644)
+    if err != nil { t.Fatal(err) }
+    doc, err = store.Load()
+    if err != nil { t.Fatal(err) }
+    if doc.Serial != 5 {
+        t.Fatalf("rolled back to %d", doc.Serial)
+    }
+
+    err = ioutil.WriteFile(path + ".good", serialize(t, &old), 0644)
+    if err != nil { t.Fatal(err) }
+    _, err = store.Load()
+    if !errors.Is(err, ErrRollback) {
+        t.Fatalf("expected rollback error, got %v", err)
+    }
+}
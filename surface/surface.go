@@ -8,6 +8,7 @@ import (
     "io"
     "crypto/x509"
     "time"
+    "errors"
 )
 
 /*
@@ -23,9 +24,10 @@ import (
     - tls connect
         - try the ingresses in order of their index. this ensures we can put fallbacks last
         - if there's a domain field, resolve the domains A and AAAA records and add them to the list of ips
-        - if there's an identity generate the cert and add it to the list of trusted roots
+        - if there's an identity, trust a chain that ends in a cert self signed by that identity
         - set SNI field if there was a record for this ingress
-        - pick a random IP and tcp connect to 443
+        - pick a random IP and tcp connect to the port field, or 443 if there is none
+        - offer the protocol fields as alpn, if there are any
         - validate server cert against any of the trust roots
         - if the certs notbefore is newer than our epoch date, we're out of sync, so ignore notbefore
         - but still respect notafter, to make sure we don't accept certs that are older than our last sync
@@ -43,6 +45,8 @@ import (
         - on signature failure drop the whole connection and try the next ingress
         - if document was updated, restart from step 0
     - request current time
+        - http get /v1/time and take the Date header. the connection is verified, so the time is authenticated
+        - never move the clock backwards
 
 
     yanking a root:
@@ -66,13 +70,17 @@ import (
     header:
     ~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
     | 1B Magic:   'S'               |
-    | 1B Version: '1'               |
+    | 1B Version: '1' or '2'        |
     | Varint  Serial                |
     | Varint  Precedent             |
     | Varint  Timestamp             |
     | 32B Sequencer identity        |
     ~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
 
+    records in version 1 carry the ingress index in the low 4 bits of their first byte, so there are at most 16.
+    version 2 records have those 4 bits zero and a varint ingress index right after the first byte,
+    followed by the same fields as in version 1. the signature record has no index in either version.
+
     1: Domain
     ---------------------------------
     | 4bit  field type              |
@@ -109,14 +117,71 @@ import (
     | 2byte len                     |
     | ... cert                      |
     ---------------------------------
+
+    6: tcp port
+    ---------------------------------
+    | 4bit  field type              |
+    | 4bit  ingress index           |
+    | 2byte port                    |
+    ---------------------------------
+
+    7: alpn protocol, in order of preference
+    ---------------------------------
+    | 4bit  field type              |
+    | 4bit  ingress index           |
+    | 1byte len                     |
+    | ... protocol                  |
+    ---------------------------------
+
+    15: signature
+    ---------------------------------
+    | 4bit  field type              |
+    | 4bit  zero                    |
+    | 64byte ed25519 signature      |
+    ---------------------------------
+
+    the signature is always the last record.
+    it covers every byte before its own header and is made by the sequencer secret of the precedent document.
+    the first document of a chain is not signed, it is trusted because it was provisioned.
+    a parser that stopped at an unknown field type still takes the signature from the end of the document,
+    so older devices can verify documents with newer field types.
+
+    unknown fields:
+    the remaining bytes starting at the first unknown field are kept as they are,
+    and appended again after all known fields when serializing,
+    so tools can modify a document that was made by a newer version without dropping what they don't understand.
+
+    text encodings:
+    where binary can't be used, the same bytes are armored as pem with type SURFACE,
+    or as an identity message with key "S". Decode accepts all three.
 */
 
+// ingresses a version 1 document can hold
+const MaxIngressesV1 = 16
+
+// v2 indexes are varints, but documents with more ingresses than this are refused
+const MaxIngresses = 256
+
 const (
     RecordTypeName      = 1
     RecordTypeV4        = 2
     RecordTypeIdentity  = 3
     RecordTypeV6        = 4
     RecordTypeX509      = 5
+    RecordTypePort      = 6
+    RecordTypeProtocol  = 7
+    RecordTypeSignature = 15
+)
+
+// prepended to the document bytes when signing, so a sequencer signature can't be confused with any other message
+const SignatureSubject = "carrier3 surface"
+
+var (
+    ErrUnsigned         = errors.New("surface document is not signed")
+    ErrBadSignature     = errors.New("surface document signature does not match precedent sequencer")
+    ErrBadPrecedent     = errors.New("surface document precedent does not match current serial")
+    ErrReusedSequencer  = errors.New("surface document reuses sequencer identity of its precedent")
+    ErrTooLarge         = errors.New("surface document too large")
 )
 
 
@@ -125,44 +190,70 @@ type Ingress struct {
     Identity    *identity.Identity          `json:",omitempty"`
     Certs       []*x509.Certificate         `json:",omitempty"`
     IP          []net.IP                    `json:",omitempty"`
+    Port        uint16                      `json:",omitempty"`
+    Protocols   []string                    `json:",omitempty"`
+}
+
+// Host is what requests to the ingress are addressed to: its Name, or its first IP if it has no name
+func (self *Ingress) Host() string {
+    if self.Name != "" || len(self.IP) == 0 {
+        return self.Name
+    }
+    if self.IP[0].To4() == nil {
+        return "[" + self.IP[0].String() + "]"
+    }
+    return self.IP[0].String()
 }
 
 type Surface struct {
+    // format version, 1 or 2. zero is written as 1, which every carrier can read
+    Version     uint8                       `json:",omitempty"`
     Serial      identity.Serial
     Precedent   identity.Serial
     Sequencer   identity.Identity
     Time        time.Time
-    Ingresses   [16]Ingress
+    Ingresses   []Ingress
+    Signature   *identity.Signature         `json:",omitempty"`
+
+    // raw fields starting at the first field type this version doesn't know
+    Unknown     []byte                      `json:",omitempty"`
+
+    // the exact bytes covered by Signature, as received
+    signed      []byte
 }
 
 func Parse(rr []byte) (*Surface, error) {
 
-    if len(rr) < (1 + 1 + 8 + 8 + 8 + 32) {
+    if len(rr) < 2 {
         return nil, fmt.Errorf("doesn't look like a surface document: too small");
     }
     if rr[0] != 'S' {
         return nil, fmt.Errorf("doesn't look like a surface document: invalid magic");
     }
-    if rr[1] != '1' {
+    if rr[1] != '1' && rr[1] != '2' {
         return nil, fmt.Errorf("carrier too old to read surface version %c", rr[1]);
     }
 
     var at = 2
 
-    doc := &Surface{}
+    doc := &Surface{Version: rr[1] - '0'}
 
     val, ra := binary.Uvarint(rr[at:])
+    if ra <= 0 { return nil, errVarint(ra) }
     at += ra
     doc.Serial  = identity.Serial(val)
 
     val, ra = binary.Uvarint(rr[at:])
+    if ra <= 0 { return nil, errVarint(ra) }
     at += ra
     doc.Precedent = identity.Serial(val)
 
     val, ra = binary.Uvarint(rr[at:])
+    if ra <= 0 { return nil, errVarint(ra) }
     at += ra
     doc.Time = time.Unix(int64(val), 0)
 
+    if at + 32 > len(rr) {return nil, io.EOF}
     copy(doc.Sequencer[:], rr[at:at+32])
     at += 32
 
@@ -173,30 +264,40 @@ func Parse(rr []byte) (*Surface, error) {
 
         h       := rr[at]
         typ     := (h & 0b11110000) >> 4
-        index   := (h & 0b00001111)
+        index   := int(h & 0b00001111)
 
         at += 1
 
+        if doc.Version > 1 && typ >= RecordTypeName && typ <= RecordTypeProtocol {
+            val, ra := binary.Uvarint(rr[at:])
+            if ra <= 0 { return nil, errVarint(ra) }
+            at += ra
+            if val >= MaxIngresses {
+                return nil, fmt.Errorf("%w: ingress index %d, at most %d ingresses are supported", ErrTooLarge, val, MaxIngresses)
+            }
+            index = int(val)
+        }
+
         switch typ {
             case RecordTypeName:
                 if at + 1 > len(rr) {return nil, io.EOF}
                 l := int(rr[at])
                 at += 1
                 if at + l > len(rr) {return nil, io.EOF}
-                doc.Ingresses[index].Name = string(rr[at: at+l])
+                doc.Ingress(index).Name = string(rr[at: at+l])
                 at += l
             case RecordTypeV4:
                 if at + 4  > len(rr) {return nil, io.EOF}
-                doc.Ingresses[index].IP = append(doc.Ingresses[index].IP, net.IPv4(rr[at], rr[at+1], rr[at+2], rr[at+3]))
+                doc.Ingress(index).IP = append(doc.Ingress(index).IP, net.IPv4(rr[at], rr[at+1], rr[at+2], rr[at+3]))
                 at += 4
             case RecordTypeIdentity:
                 if at + 32 > len(rr) {return nil, io.EOF}
-                doc.Ingresses[index].Identity = &identity.Identity{}
-                copy(doc.Ingresses[index].Identity[:], rr[at:at+32])
+                doc.Ingress(index).Identity = &identity.Identity{}
+                copy(doc.Ingress(index).Identity[:], rr[at:at+32])
                 at += 32
             case RecordTypeV6:
                 if at + 16 > len(rr) {return nil, io.EOF}
-                doc.Ingresses[index].IP = append(doc.Ingresses[index].IP, rr[at:at+16])
+                doc.Ingress(index).IP = append(doc.Ingress(index).IP, append(net.IP{}, rr[at:at+16]...))
                 at += 16
             case RecordTypeX509:
                 if at + 2 > len(rr) {return nil, io.EOF}
@@ -206,12 +307,41 @@ func Parse(rr []byte) (*Surface, error) {
 
                 crt, err := x509.ParseCertificate(rr[at: at+l])
                 if err == nil {
-                    doc.Ingresses[index].Certs = append(doc.Ingresses[index].Certs, crt)
+                    doc.Ingress(index).Certs = append(doc.Ingress(index).Certs, crt)
                 }
 
                 at += l
+            case RecordTypePort:
+                if at + 2 > len(rr) {return nil, io.EOF}
+                doc.Ingress(index).Port = binary.LittleEndian.Uint16(rr[at:at+2])
+                at += 2
+            case RecordTypeProtocol:
+                if at + 1 > len(rr) {return nil, io.EOF}
+                l := int(rr[at])
+                at += 1
+                if at + l > len(rr) {return nil, io.EOF}
+                doc.Ingress(index).Protocols = append(doc.Ingress(index).Protocols, string(rr[at: at+l]))
+                at += l
+            case RecordTypeSignature:
+                if index != 0 || at + 64 != len(rr) {
+                    return nil, fmt.Errorf("signature must be the last record of a surface document")
+                }
+                doc.Signature = &identity.Signature{}
+                copy(doc.Signature[:], rr[at:at+64])
+                doc.signed = append([]byte{}, rr[:at-1]...)
+                at += 64
             default:
-                break
+                // stop at the first unknown field, since we can't know its length.
+                // the signature is still at the end, if there is one
+                tail := rr[at-1:]
+                if len(tail) >= 1 + 1 + 64 && tail[len(tail) - 65] == uint8(RecordTypeSignature << 4) {
+                    doc.Signature = &identity.Signature{}
+                    copy(doc.Signature[:], tail[len(tail) - 64:])
+                    doc.signed  = append([]byte{}, rr[:len(rr) - 65]...)
+                    tail        = tail[:len(tail) - 65]
+                }
+                doc.Unknown = append([]byte{}, tail...)
+                return doc, nil
         }
 
     }
@@ -219,48 +349,197 @@ func Parse(rr []byte) (*Surface, error) {
     return doc, nil
 }
 
-func (doc *Surface) Serialize() []byte {
-    var b [32767]byte
+// the format version Serialize writes
+func (doc *Surface) version() uint8 {
+    if doc.Version == 0 {
+        return 1
+    }
+    return doc.Version
+}
 
-    b[0] = 'S'
-    b[1] = '1'
+// Ingress returns the ingress at index, growing Ingresses if it doesn't exist yet
+func (doc *Surface) Ingress(index int) *Ingress {
+    for len(doc.Ingresses) <= index {
+        doc.Ingresses = append(doc.Ingresses, Ingress{})
+    }
+    return &doc.Ingresses[index]
+}
 
-    var at = 2
+// binary.Uvarint returns 0 if the buffer ended and a negative length if the value overflows
+func errVarint(ra int) error {
+    if ra == 0 {
+        return io.EOF
+    }
+    return fmt.Errorf("doesn't look like a surface document: varint overflows 64 bits")
+}
 
-    at += binary.PutUvarint(b[at:], uint64(doc.Serial))
-    at += binary.PutUvarint(b[at:], uint64(doc.Precedent))
-    at += binary.PutUvarint(b[at:], uint64(doc.Time.Unix()))
-    copy(b[at:at+32], doc.Sequencer[:])
-    at += 32
+// UnknownType returns the type of the first field this version doesn't know, if there was one
+func (doc *Surface) UnknownType() (uint8, bool) {
+    if len(doc.Unknown) == 0 {
+        return 0, false
+    }
+    return (doc.Unknown[0] & 0b11110000) >> 4, true
+}
+
+// ParseSigned parses a document and verifies it is a valid successor of prev
+func ParseSigned(rr []byte, prev *Surface) (*Surface, error) {
+    doc, err := Parse(rr)
+    if err != nil { return nil, err }
+
+    err = doc.Verify(prev)
+    if err != nil { return nil, err }
+
+    return doc, nil
+}
+
+// Sign the document with the sequencer secret of its precedent
+func (doc *Surface) Sign(signer identity.Signer) error {
+    body, err := doc.serializeBody()
+    if err != nil { return err }
 
+    sig, err := signer.Sign(SignatureSubject, body)
+    if err != nil { return err }
+
+    doc.Signature   = sig
+    doc.signed      = body
+    return nil
+}
+
+// Next returns a copy of the document that continues its chain,
+// with the precedent set to this serial, the next serial, time t and a fresh sequencer.
+// it still needs to be signed with the sequencer secret of this document.
+// the returned secret is the one that will sign the document after it.
+func (doc *Surface) Next(t time.Time) (*Surface, *identity.Secret, error) {
+
+    secret, err := identity.CreateSecret()
+    if err != nil { return nil, nil, err }
+
+    seq, err := secret.Identity()
+    if err != nil { return nil, nil, err }
+
+    next := &Surface{
+        Version:    doc.Version,
+        Serial:     doc.Serial + 1,
+        Precedent:  doc.Serial,
+        Sequencer:  *seq,
+        Time:       t,
+        Unknown:    append([]byte{}, doc.Unknown...),
+        Ingresses:  make([]Ingress, len(doc.Ingresses)),
+    }
+
+    for i, ingress := range doc.Ingresses {
+        next.Ingresses[i] = Ingress{
+            Name:       ingress.Name,
+            Certs:      append([]*x509.Certificate{}, ingress.Certs...),
+            IP:         append([]net.IP{}, ingress.IP...),
+            Port:       ingress.Port,
+            Protocols:  append([]string{}, ingress.Protocols...),
+        }
+        if ingress.Identity != nil {
+            id := *ingress.Identity
+            next.Ingresses[i].Identity = &id
+        }
+    }
+
+    return next, secret, nil
+}
+
+// Verify checks that the document was signed by the sequencer of prev and continues its chain
+func (doc *Surface) Verify(prev *Surface) error {
+    if doc.Signature == nil {
+        return ErrUnsigned
+    }
+    if prev == nil {
+        return fmt.Errorf("cannot verify surface document %d without its precedent", doc.Serial)
+    }
+    if doc.Precedent != prev.Serial {
+        return fmt.Errorf("%w: got %d, expected %d", ErrBadPrecedent, doc.Precedent, prev.Serial)
+    }
+    if doc.Sequencer.Equal(&prev.Sequencer) {
+        return ErrReusedSequencer
+    }
+
+    signed := doc.signed
+    if signed == nil {
+        var err error
+        signed, err = doc.serializeBody()
+        if err != nil { return err }
+    }
+
+    if !doc.Signature.Verify(SignatureSubject, signed, &prev.Sequencer) {
+        return ErrBadSignature
+    }
+
+    return nil
+}
+
+// Serialize returns the document in the format of its Version.
+// it fails with ErrTooLarge instead of leaving out anything that doesn't fit.
+func (doc *Surface) Serialize() ([]byte, error) {
+    b, err := doc.serializeBody()
+    if err != nil { return nil, err }
+
+    if doc.Signature != nil {
+        b = append(b, uint8(RecordTypeSignature << 4))
+        b = append(b, doc.Signature[:]...)
+    }
+
+    return b, nil
+}
+
+func (doc *Surface) serializeBody() ([]byte, error) {
+
+    var version = doc.version()
+
+    var maxIngresses, maxSize int
+    switch version {
+        case 1:
+            maxIngresses, maxSize = MaxIngressesV1, MaxDocumentSize
+        case 2:
+            maxIngresses, maxSize = MaxIngresses, MaxDocumentSizeV2
+        default:
+            return nil, fmt.Errorf("cannot write surface version %d", version)
+    }
+
+    if len(doc.Ingresses) > maxIngresses {
+        return nil, fmt.Errorf("%w: %d ingresses, version %d holds at most %d", ErrTooLarge, len(doc.Ingresses), version, maxIngresses)
+    }
+
+    var tmp [binary.MaxVarintLen64]byte
+
+    b := make([]byte, 0, 1024)
+    b = append(b, 'S', '0' + version)
+    b = append(b, tmp[:binary.PutUvarint(tmp[:], uint64(doc.Serial))]...)
+    b = append(b, tmp[:binary.PutUvarint(tmp[:], uint64(doc.Precedent))]...)
+    b = append(b, tmp[:binary.PutUvarint(tmp[:], uint64(doc.Time.Unix()))]...)
+    b = append(b, doc.Sequencer[:]...)
+
+    record := func(typ uint8, i int) {
+        if version == 1 {
+            b = append(b, uint8(( typ << 4 ) | uint8(i)))
+        } else {
+            b = append(b, uint8(typ << 4))
+            b = append(b, tmp[:binary.PutUvarint(tmp[:], uint64(i))]...)
+        }
+    }
 
     // name
     for i, ep := range doc.Ingresses {
         if ep.Name == ""  { continue }
-        s := []byte(ep.Name)
-        if len(s) > 255 {s=s[:255]}
-        if at + 1 + 1 + len(s) >= len(b) {
-            break
+        if len(ep.Name) > 255 {
+            return nil, fmt.Errorf("%w: ingress %d: name is longer than 255 bytes", ErrTooLarge, i)
         }
-        b[at] = uint8(( RecordTypeName << 4 ) | i)
-        at += 1
-        b[at] = uint8(len(s))
-        at += 1
-        copy(b[at:], s[:])
-        at += len(s)
+        record(RecordTypeName, i)
+        b = append(b, uint8(len(ep.Name)))
+        b = append(b, ep.Name...)
     }
 
     // v4
     for i, ep := range doc.Ingresses {
         for _, ip := range ep.IP {
             if v4 := ip.To4() ; v4 != nil {
-                if at + 1 + 4 >= len(b) {
-                    break
-                }
-                b[at] = uint8(( RecordTypeV4 << 4 ) | i)
-                at += 1
-                copy(b[at:at+4], v4[:])
-                at += 4
+                record(RecordTypeV4, i)
+                b = append(b, v4...)
             }
         }
     }
@@ -268,27 +547,19 @@ func (doc *Surface) Serialize() []byte {
     // identity
     for i, ep := range doc.Ingresses {
         if ep.Identity == nil { continue }
-
-        if at + 1 + 32 >= len(b) {
-            break
-        }
-        b[at] = uint8(( RecordTypeIdentity << 4 ) | i)
-        at += 1
-        copy(b[at:at+32], ep.Identity[:])
-        at += 32
+        record(RecordTypeIdentity, i)
+        b = append(b, ep.Identity[:]...)
     }
 
     // v6
     for i, ep := range doc.Ingresses {
         for _, ip := range ep.IP {
             if v4 := ip.To4() ; v4 == nil {
-                if at + 1 + 16 >= len(b) {
-                    break
+                if len(ip) != net.IPv6len {
+                    return nil, fmt.Errorf("ingress %d: invalid ip %v", i, ip)
                 }
-                b[at] = uint8(( RecordTypeV6 << 4 ) | i)
-                at += 1
-                copy(b[at:at+16], ip[:])
-                at += 16
+                record(RecordTypeV6, i)
+                b = append(b, ip...)
             }
         }
     }
@@ -299,19 +570,46 @@ func (doc *Surface) Serialize() []byte {
 
             der := cert.Raw
 
-            if der == nil || len(der) > 16000 { continue }
-            if at + 1 + 2 + len(der) >= len(b) {
-                break
+            if der == nil { continue }
+            if len(der) > MaxCertSize {
+                return nil, fmt.Errorf("%w: ingress %d: cert %s is %d bytes, at most %d are allowed", ErrTooLarge, i, certName(cert), len(der), MaxCertSize)
             }
 
-            b[at] = uint8(( RecordTypeX509 << 4 ) | i)
-            at += 1
-            binary.LittleEndian.PutUint16(b[at:at+2], uint16(len(der)))
-            at += 2
-            copy(b[at:], der[:])
-            at += len(der)
+            record(RecordTypeX509, i)
+            b = append(b, 0, 0)
+            binary.LittleEndian.PutUint16(b[len(b)-2:], uint16(len(der)))
+            b = append(b, der...)
+        }
+    }
+
+    // port
+    for i, ep := range doc.Ingresses {
+        if ep.Port == 0 { continue }
+        record(RecordTypePort, i)
+        b = append(b, 0, 0)
+        binary.LittleEndian.PutUint16(b[len(b)-2:], ep.Port)
+    }
+
+    // protocol
+    for i, ep := range doc.Ingresses {
+        for _, proto := range ep.Protocols {
+            if len(proto) == 0 { continue }
+            if len(proto) > 255 {
+                return nil, fmt.Errorf("%w: ingress %d: alpn protocol is longer than 255 bytes", ErrTooLarge, i)
+            }
+            record(RecordTypeProtocol, i)
+            b = append(b, uint8(len(proto)))
+            b = append(b, proto...)
         }
     }
 
-    return b[:at]
+    // fields from a newer version
+    b = append(b, doc.Unknown...)
+
+    // leave room for the signature record
+    if len(b) > maxSize - 1 - 64 {
+        return nil, fmt.Errorf("%w: %d bytes, version %d allows %d before the signature", ErrTooLarge, len(b), version, maxSize - 1 - 64)
+    }
+
+    return b, nil
 }
@@ -32,6 +32,7 @@ func TestA(t *testing.T) {
         Sequencer:      *pk,
     }
 
+    in.Ingresses = make([]Ingress, 2)
     in.Ingresses[0] = Ingress{
         Name: "s1189.ingress.devguard.io",
         IP: []net.IP {
@@ -46,7 +47,7 @@ func TestA(t *testing.T) {
     }
     in.Ingresses[1].Certs = append(in.Ingresses[1].Certs, crt)
 
-    b := in.Serialize()
+    b := serialize(t, &in)
 
 
 
@@ -91,3 +92,183 @@ func TestA(t *testing.T) {
     }
 
 }
+
+func serialize(t testing.TB, doc *Surface) []byte {
+    t.Helper()
+    b, err := doc.Serialize()
+    if err != nil { t.Fatal(err) }
+    return b
+}
+
+func TestSigned(t *testing.T) {
+
+    secret1, err := identity.CreateSecret()
+    if err != nil { panic(err) }
+    seq1, err := secret1.Identity()
+    if err != nil { panic(err) }
+
+    secret2, err := identity.CreateSecret()
+    if err != nil { panic(err) }
+    seq2, err := secret2.Identity()
+    if err != nil { panic(err) }
+
+    var genesis = Surface {
+        Serial:         1,
+        Time:           time.Now(),
+        Sequencer:      *seq1,
+    }
+    genesis.Ingress(0).Name = "s1.ingress.devguard.io"
+
+    var next = Surface {
+        Serial:         2,
+        Precedent:      1,
+        Time:           time.Now(),
+        Sequencer:      *seq2,
+    }
+    next.Ingress(0).Name = "s2.ingress.devguard.io"
+
+    _, err = ParseSigned(serialize(t, &next), &genesis)
+    if err != ErrUnsigned {
+        t.Fatalf("expected unsigned error, got %v", err)
+    }
+
+    err = next.Sign(secret1)
+    if err != nil { t.Fatal(err) }
+
+    b := serialize(t, &next)
+
+    out, err := ParseSigned(b, &genesis)
+    if err != nil { t.Fatal(err) }
+    if out.Ingresses[0].Name != next.Ingresses[0].Name {
+        t.Fatalf("name mismatch: %s", out.Ingresses[0].Name)
+    }
+
+    // signed by the wrong sequencer
+    _, err = ParseSigned(b, out)
+    if err == nil {
+        t.Fatal("accepted document as its own successor")
+    }
+
+    // tampered
+    b[len(b) - 70] ^= 1
+    _, err = ParseSigned(b, &genesis)
+    if err != ErrBadSignature {
+        t.Fatalf("expected bad signature, got %v", err)
+    }
+}
+
+func TestNext(t *testing.T) {
+
+    secret1, err := identity.CreateSecret()
+    if err != nil { panic(err) }
+    seq1, err := secret1.Identity()
+    if err != nil { panic(err) }
+
+    var genesis = Surface {
+        Serial:         4,
+        Precedent:      3,
+        Time:           time.Now(),
+        Sequencer:      *seq1,
+    }
+    genesis.Ingress(0).Name = "s1.ingress.devguard.io"
+    genesis.Ingress(0).IP   = []net.IP{net.ParseIP("10.0.0.1")}
+
+    next, secret2, err := genesis.Next(time.Now())
+    if err != nil { t.Fatal(err) }
+
+    if next.Serial != 5 || next.Precedent != 4 {
+        t.Fatalf("expected serial 5 after 4, got %d after %d", next.Serial, next.Precedent)
+    }
+
+    seq2, err := secret2.Identity()
+    if err != nil { t.Fatal(err) }
+    if next.Sequencer != *seq2 || next.Sequencer == genesis.Sequencer {
+        t.Fatal("expected a fresh sequencer matching the returned secret")
+    }
+
+    // ingresses are copies
+    next.Ingresses[0].IP[0] = net.ParseIP("10.0.0.2")
+    next.Ingresses[0].IP = append(next.Ingresses[0].IP, net.ParseIP("10.0.0.3"))
+    if len(genesis.Ingresses[0].IP) != 1 || !genesis.Ingresses[0].IP[0].Equal(net.ParseIP("10.0.0.1")) {
+        t.Fatalf("editing next changed its precedent: %v", genesis.Ingresses[0].IP)
+    }
+
+    err = next.Sign(secret1)
+    if err != nil { t.Fatal(err) }
+
+    out, err := ParseSigned(serialize(t, next), &genesis)
+    if err != nil { t.Fatal(err) }
+    if out.Ingresses[0].Name != genesis.Ingresses[0].Name {
+        t.Fatalf("name mismatch: %s", out.Ingresses[0].Name)
+    }
+}
+
+func TestPortProtocol(t *testing.T) {
+
+    var in = Surface {
+        Serial:         2,
+        Precedent:      1,
+        Time:           time.Now(),
+    }
+    in.Ingress(0).Name        = "s2.ingress.devguard.io"
+    in.Ingress(3).Name        = "fallback.devguard.io"
+    in.Ingress(3).Port        = 8443
+    in.Ingress(3).Protocols   = []string{"h2", "http/1.1"}
+
+    out, err := Parse(serialize(t, &in))
+    if err != nil { t.Fatal(err) }
+
+    if out.Ingresses[0].Port != 0 || len(out.Ingresses[0].Protocols) != 0 {
+        t.Fatalf("unexpected port or protocol on ingress 0")
+    }
+    if out.Ingresses[3].Port != 8443 {
+        t.Fatalf("port: %d", out.Ingresses[3].Port)
+    }
+    if len(out.Ingresses[3].Protocols) != 2 || out.Ingresses[3].Protocols[0] != "h2" || out.Ingresses[3].Protocols[1] != "http/1.1" {
+        t.Fatalf("protocols: %v", out.Ingresses[3].Protocols)
+    }
+}
+
+func TestUnknown(t *testing.T) {
+
+    secret, err := identity.CreateSecret()
+    if err != nil { t.Fatal(err) }
+    seq, err := secret.Identity()
+    if err != nil { t.Fatal(err) }
+
+    var prev = Surface{Serial: 1, Sequencer: *seq}
+
+    var in = Surface {
+        Serial:         2,
+        Precedent:      1,
+        Time:           time.Now(),
+    }
+    in.Ingress(0).Name = "s2.ingress.devguard.io"
+    in.Ingress(1).Name = "fallback.devguard.io"
+
+    // a record type from the future, followed by something that looks like a name record
+    in.Unknown = []byte{0xc1, 0x10, 0x02, 'x', 'y'}
+
+    err = in.Sign(secret)
+    if err != nil { t.Fatal(err) }
+
+    b := serialize(t, &in)
+    out, err := ParseSigned(b, &prev)
+    if err != nil { t.Fatal(err) }
+
+    typ, ok := out.UnknownType()
+    if !ok || typ != 0xc {
+        t.Fatalf("unknown type: %d %v", typ, ok)
+    }
+    if out.Ingresses[1].Name != "fallback.devguard.io" {
+        t.Fatalf("ingress 1: %s", out.Ingresses[1].Name)
+    }
+    if out.Ingresses[0].Name != "s2.ingress.devguard.io" {
+        t.Fatalf("parsed past unknown record: %s", out.Ingresses[0].Name)
+    }
+
+    b2 := serialize(t, out)
+    if string(b) != string(b2) {
+        t.Fatalf("round trip changed the document")
+    }
+}
@@ -0,0 +1,142 @@
+package surface
+
+import (
+    "github.com/devguardio/identity/go"
+    log "github.com/sirupsen/logrus"
+    "net"
+    "net/http"
+    "context"
+    "bufio"
+    "io"
+    "io/ioutil"
+    "fmt"
+    "time"
+)
+
+// Updater walks the document chain forward over an established ingress connection.
+//
+// successors are served as static files, so an ingress that has been retired because its root leaked
+// can still hand out the document that replaces it.
+type Updater struct {
+    // called with every verified successor before it is used, so it can be persisted.
+    // returning an error aborts the update
+    OnUpdate    func(*Surface) error
+
+    // how many successors to fetch over one connection. defaults to 16
+    MaxHops     int
+
+    // deadline for the whole update if the context has none. defaults to 10 seconds
+    Timeout     time.Duration
+}
+
+// UpdateError is a successor an ingress served that doesn't parse or doesn't continue the chain.
+// unlike a timeout or a broken connection, it means the ingress can't be trusted
+type UpdateError struct {
+    Precedent   identity.Serial
+    Err         error
+}
+
+func (self *UpdateError) Error() string {
+    return fmt.Sprintf("successor of surface document %d: %v", self.Precedent, self.Err)
+}
+
+func (self *UpdateError) Unwrap() error {
+    return self.Err
+}
+
+// NextPath is where an ingress serves the document that follows serial
+func NextPath(serial identity.Serial) string {
+    return fmt.Sprintf("/surface/%d.next", serial)
+}
+
+// Update fetches successors of current until the ingress has none or MaxHops is reached.
+// every successor must be signed by the sequencer of the document before it.
+// returns nil if current is already the latest document.
+// The connection stays usable for further requests if no error is returned.
+//
+// on error, the last successor that was verified and passed to OnUpdate is still returned, if there is one,
+// so a device far behind on a slow link keeps the hops it made before a timeout.
+// a successor that doesn't verify is reported as *UpdateError.
+// if the ingress closes the connection after a response, what was fetched until then is returned with ErrUpdateClosed
+func (self *Updater) Update(ctx context.Context, conn net.Conn, host string, current *Surface) (*Surface, error) {
+
+    var maxHops = self.MaxHops
+    if maxHops == 0 {
+        maxHops = 16
+    }
+
+    deadline, ok := ctx.Deadline()
+    if !ok {
+        var timeout = self.Timeout
+        if timeout == 0 {
+            timeout = 10 * time.Second
+        }
+        deadline = time.Now().Add(timeout)
+    }
+    conn.SetDeadline(deadline)
+    defer conn.SetDeadline(time.Time{})
+
+    var latest  = current
+    var updated *Surface
+    var bio     = bufio.NewReader(conn)
+
+    for hop := 0; hop < maxHops; hop++ {
+
+        next, closed, err := self.fetch(ctx, conn, bio, host, latest)
+        if err != nil { return updated, err }
+
+        if next != nil {
+            if self.OnUpdate != nil {
+                err = self.OnUpdate(next)
+                if err != nil { return updated, err }
+            }
+
+            log.WithField("serial", next.Serial).WithField("precedent", next.Precedent).Info("surface document updated");
+
+            latest  = next
+            updated = next
+        }
+
+        if closed { return updated, ErrUpdateClosed }
+        if next == nil { break }
+    }
+
+    if bio.Buffered() != 0 {
+        return updated, fmt.Errorf("ingress sent unexpected data after surface update")
+    }
+
+    return updated, nil
+}
+
+func (self *Updater) fetch(ctx context.Context, conn net.Conn, bio *bufio.Reader, host string, current *Surface) (*Surface, bool, error) {
+
+    req, err := http.NewRequestWithContext(ctx, "GET", "http://" + host + NextPath(current.Serial), nil)
+    if err != nil { return nil, false, err }
+
+    err = req.Write(conn)
+    if err != nil { return nil, false, err }
+
+    resp, err := http.ReadResponse(bio, req)
+    if err != nil { return nil, false, err }
+    defer resp.Body.Close()
+
+    body, err := ioutil.ReadAll(io.LimitReader(resp.Body, MaxDocumentSizeV2 + 1))
+    if err != nil { return nil, false, err }
+
+    // the response still counts, only the connection is done
+    closed := resp.Close
+
+    if resp.StatusCode == http.StatusNotFound {
+        return nil, closed, nil
+    }
+    if resp.StatusCode != http.StatusOK {
+        return nil, closed, fmt.Errorf("surface update: %s", resp.Status)
+    }
+    if len(body) > MaxDocumentSizeV2 {
+        return nil, closed, fmt.Errorf("surface update: document too large")
+    }
+
+    doc, err := ParseSigned(body, current)
+    if err != nil { return nil, closed, &UpdateError{Precedent: current.Serial, Err: err} }
+    return doc, closed, nil
+}
@@ -0,0 +1,312 @@
+package surface
+
+import (
+    "github.com/devguardio/identity/go"
+    "testing"
+    "net"
+    "net/http"
+    "crypto/tls"
+    "context"
+    "errors"
+    "time"
+)
+
+// a chain of n documents from serial 10, each signed by the sequencer of the one before
+func testChain(t *testing.T, n int, ingress Ingress) []*Surface {
+    var chain []*Surface
+    var secret *identity.Secret
+    for i := 0; i < n; i++ {
+        next, err := identity.CreateSecret()
+        if err != nil { t.Fatal(err) }
+        seq, err := next.Identity()
+        if err != nil { t.Fatal(err) }
+
+        doc := &Surface{
+            Serial:     identity.Serial(10 + i),
+            Precedent:  identity.Serial(9 + i),
+            Time:       time.Now(),
+            Sequencer:  *seq,
+        }
+        doc.Ingresses = []Ingress{ingress}
+        if secret != nil {
+            err = doc.Sign(secret)
+            if err != nil { t.Fatal(err) }
+        }
+        chain  = append(chain, doc)
+        secret = next
+    }
+    return chain
+}
+
+func TestUpdate(t *testing.T) {
+
+    chain := testChain(t, 4, Ingress{Name: "ingress.example.com"})
+
+    mux := http.NewServeMux()
+    for _, doc := range chain[1:] {
+        b := serialize(t, doc)
+        mux.HandleFunc(NextPath(doc.Precedent), func(w http.ResponseWriter, r *http.Request) {
+            w.Write(b)
+        })
+    }
+
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil { t.Fatal(err) }
+    defer ln.Close()
+    go http.Serve(ln, mux)
+
+    conn, err := net.Dial("tcp", ln.Addr().String())
+    if err != nil { t.Fatal(err) }
+    defer conn.Close()
+
+    var persisted []*Surface
+    updater := &Updater{
+        OnUpdate: func(doc *Surface) error {
+            persisted = append(persisted, doc)
+            return nil
+        },
+    }
+
+    latest, err := updater.Update(context.Background(), conn, "ingress.example.com", chain[0])
+    if err != nil { t.Fatal(err) }
+    if latest == nil || latest.Serial != 13 {
+        t.Fatalf("expected to end at serial 13, got %v", latest)
+    }
+    if len(persisted) != 3 {
+        t.Fatalf("expected 3 updates, got %d", len(persisted))
+    }
+
+    // already at the latest document
+    latest, err = updater.Update(context.Background(), conn, "ingress.example.com", chain[3])
+    if err != nil { t.Fatal(err) }
+    if latest != nil {
+        t.Fatalf("unexpected update to %d", latest.Serial)
+    }
+
+    // a document that doesn't continue our chain is refused
+    mux.HandleFunc(NextPath(99), func(w http.ResponseWriter, r *http.Request) {
+        w.Write(serialize(t, chain[3]))
+    })
+    _, err = updater.Update(context.Background(), conn, "ingress.example.com", &Surface{Serial: 99, Sequencer: chain[2].Sequencer})
+    if err == nil {
+        t.Fatal("accepted document with wrong precedent")
+    }
+    var bad *UpdateError
+    if !errors.As(err, &bad) || !errors.Is(err, ErrBadPrecedent) {
+        t.Fatalf("expected UpdateError with ErrBadPrecedent, got %v", err)
+    }
+}
+
+// a walk that breaks off halfway keeps the verified hops
+func TestUpdatePartial(t *testing.T) {
+
+    chain := testChain(t, 4, Ingress{Name: "ingress.example.com"})
+
+    mux := http.NewServeMux()
+    for _, doc := range chain[1:3] {
+        b := serialize(t, doc)
+        mux.HandleFunc(NextPath(doc.Precedent), func(w http.ResponseWriter, r *http.Request) {
+            w.Write(b)
+        })
+    }
+    // the link dies on the third hop
+    mux.HandleFunc(NextPath(chain[2].Serial), func(w http.ResponseWriter, r *http.Request) {
+        conn, _, err := w.(http.Hijacker).Hijack()
+        if err == nil { conn.Close() }
+    })
+
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil { t.Fatal(err) }
+    defer ln.Close()
+    go http.Serve(ln, mux)
+
+    conn, err := net.Dial("tcp", ln.Addr().String())
+    if err != nil { t.Fatal(err) }
+    defer conn.Close()
+
+    var persisted []*Surface
+    updater := &Updater{
+        OnUpdate: func(doc *Surface) error {
+            persisted = append(persisted, doc)
+            return nil
+        },
+    }
+
+    latest, err := updater.Update(context.Background(), conn, "ingress.example.com", chain[0])
+    if err == nil {
+        t.Fatal("expected an error from the broken hop")
+    }
+    var bad *UpdateError
+    if errors.As(err, &bad) {
+        t.Fatalf("a broken connection is not a bad document: %v", err)
+    }
+    if latest == nil || latest.Serial != 12 || len(persisted) != 2 {
+        t.Fatalf("expected to keep serial 12 after 2 updates, got %v after %d", latest, len(persisted))
+    }
+}
+
+// the dialer adopts the hops of a broken walk and continues on a new connection
+func TestDialerUpdatePartial(t *testing.T) {
+
+    const name = "ingress.test"
+
+    secret, err := identity.CreateSecret()
+    if err != nil { t.Fatal(err) }
+    id, err := secret.Identity()
+    if err != nil { t.Fatal(err) }
+
+    ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+        Certificates:   []tls.Certificate{identityChain(t, secret, name)},
+        ClientAuth:     tls.RequireAnyClientCert,
+    })
+    if err != nil { t.Fatal(err) }
+    defer ln.Close()
+
+    chain := testChain(t, 4, Ingress{
+        Name:       name,
+        IP:         []net.IP{net.ParseIP("127.0.0.1")},
+        Identity:   id,
+        Port:       uint16(ln.Addr().(*net.TCPAddr).Port),
+    })
+
+    var broken = false
+    mux := http.NewServeMux()
+    for _, doc := range chain[1:] {
+        doc := doc
+        mux.HandleFunc(NextPath(doc.Precedent), func(w http.ResponseWriter, r *http.Request) {
+            // the first connection dies on the second hop
+            if doc.Serial == 12 && !broken {
+                broken = true
+                conn, _, err := w.(http.Hijacker).Hijack()
+                if err == nil { conn.Close() }
+                return
+            }
+            w.Write(serialize(t, doc))
+        })
+    }
+    go http.Serve(ln, mux)
+
+    var persisted []*Surface
+    dialer := NewDialer(identity.Vault(), chain[0])
+    dialer.Resolver = StaticResolver{}
+    dialer.Updater  = &Updater{
+        OnUpdate: func(doc *Surface) error {
+            persisted = append(persisted, doc)
+            return nil
+        },
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+    defer cancel()
+
+    conn, _, err := dialer.DialContext(ctx)
+    if err != nil { t.Fatal(err) }
+    conn.Close()
+
+    if !broken {
+        t.Fatal("the walk never broke off")
+    }
+    if dialer.Surface.Serial != 13 || len(persisted) != 3 {
+        t.Fatalf("expected to end at serial 13 after 3 updates, got %d after %d", dialer.Surface.Serial, len(persisted))
+    }
+}
+
+// an ingress that closes every connection after one answer still hands out successors
+func TestUpdateClose(t *testing.T) {
+
+    chain := testChain(t, 3, Ingress{Name: "ingress.example.com"})
+
+    mux := http.NewServeMux()
+    for _, doc := range chain[1:] {
+        b := serialize(t, doc)
+        mux.HandleFunc(NextPath(doc.Precedent), func(w http.ResponseWriter, r *http.Request) {
+            w.Header().Set("Connection", "close")
+            w.Write(b)
+        })
+    }
+    mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Connection", "close")
+        http.NotFound(w, r)
+    })
+
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil { t.Fatal(err) }
+    defer ln.Close()
+    go http.Serve(ln, mux)
+
+    update := func(current *Surface) (*Surface, error) {
+        conn, err := net.Dial("tcp", ln.Addr().String())
+        if err != nil { t.Fatal(err) }
+        defer conn.Close()
+        return (&Updater{}).Update(context.Background(), conn, "ingress.example.com", current)
+    }
+
+    latest, err := update(chain[0])
+    if !errors.Is(err, ErrUpdateClosed) {
+        t.Fatalf("expected ErrUpdateClosed, got %v", err)
+    }
+    if latest == nil || latest.Serial != 11 {
+        t.Fatalf("expected the successor despite the close, got %v", latest)
+    }
+
+    // up to date, and nothing is wrong with the ingress
+    latest, err = update(chain[2])
+    var bad *UpdateError
+    if !errors.Is(err, ErrUpdateClosed) || errors.As(err, &bad) || latest != nil {
+        t.Fatalf("expected only ErrUpdateClosed, got %v %v", latest, err)
+    }
+}
+
+// the dialer walks the chain one connection per hop and then connects without updating
+func TestDialerUpdateClose(t *testing.T) {
+
+    const name = "ingress.test"
+
+    secret, err := identity.CreateSecret()
+    if err != nil { t.Fatal(err) }
+    id, err := secret.Identity()
+    if err != nil { t.Fatal(err) }
+
+    ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+        Certificates:   []tls.Certificate{identityChain(t, secret, name)},
+        ClientAuth:     tls.RequireAnyClientCert,
+    })
+    if err != nil { t.Fatal(err) }
+    defer ln.Close()
+
+    chain := testChain(t, 3, Ingress{
+        Name:       name,
+        IP:         []net.IP{net.ParseIP("127.0.0.1")},
+        Identity:   id,
+        Port:       uint16(ln.Addr().(*net.TCPAddr).Port),
+    })
+
+    mux := http.NewServeMux()
+    for _, doc := range chain[1:] {
+        b := serialize(t, doc)
+        mux.HandleFunc(NextPath(doc.Precedent), func(w http.ResponseWriter, r *http.Request) {
+            w.Header().Set("Connection", "close")
+            w.Write(b)
+        })
+    }
+    mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Connection", "close")
+        http.NotFound(w, r)
+    })
+    go http.Serve(ln, mux)
+
+    dialer := NewDialer(identity.Vault(), chain[0])
+    dialer.Resolver = StaticResolver{}
+    dialer.Updater  = &Updater{}
+
+    ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+    defer cancel()
+
+    conn, _, err := dialer.DialContext(ctx)
+    if err != nil { t.Fatal(err) }
+    conn.Close()
+
+    if dialer.Surface.Serial != 12 {
+        t.Fatalf("expected to end at serial 12, got %d", dialer.Surface.Serial)
+    }
+}